@@ -0,0 +1,64 @@
+package lapis
+
+import "time"
+
+// weight of the newest observation in the moving averages
+const ewmaWeight = 0.2
+
+// exponentially weighted moving average of durations
+type ewma struct {
+	value    float64
+	observed bool
+}
+
+func (e *ewma) observe(d time.Duration) {
+	if !e.observed {
+		e.value = float64(d)
+		e.observed = true
+		return
+	}
+	e.value = ewmaWeight*float64(d) + (1-ewmaWeight)*e.value
+}
+
+func (e *ewma) duration() time.Duration {
+	return time.Duration(e.value)
+}
+
+// record the arrival of a new key, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) recordArrival() {
+	if !l.adaptive {
+		return
+	}
+	now := time.Now()
+	if !l.lastArrival.IsZero() {
+		l.arrivalInterval.observe(now.Sub(l.lastArrival))
+	}
+	l.lastArrival = now
+}
+
+// get the wait duration for a new batch, must be called while holding the lock
+//
+// The adaptive wait is the shortest of the time needed to fill a batch at the current arrival rate and the recent
+// latency of the layers: waiting longer than the fill time is useless since the batch will be dispatched when it
+// is full, and waiting longer than the layers latency costs more than it saves. When keys arrive slower than the
+// maximum wait, there is nothing to batch and the minimum wait is used.
+func (l *Batcher[TKey, TValue]) nextWait() time.Duration {
+	if !l.adaptive || !l.latency.observed {
+		return l.wait
+	}
+	interval := l.arrivalInterval.duration()
+	if !l.arrivalInterval.observed || interval >= l.maxWait {
+		return l.minWait
+	}
+	wait := l.latency.duration()
+	if fill := interval * time.Duration(l.maxBatch); fill < wait {
+		wait = fill
+	}
+	if wait < l.minWait {
+		return l.minWait
+	}
+	if wait > l.maxWait {
+		return l.maxWait
+	}
+	return wait
+}
@@ -1,77 +1,93 @@
 package lapis
 
-import (
-	"time"
-)
+import "time"
 
 // a batch of keys to be resolved
 type batch[TKey comparable, TValue any] struct {
-	keys    []TKey
-	data    []TValue
-	errors  []error
-	done    []chan struct{} // channels to notify if any of each keys in this batch has been resolved
-	allDone chan struct{}   // channel to notify that all keys in this batch has been resolved
-	closing bool            // flags this batch as closed, no more keys can be added in this batch
+	options   loadOptions // load options shared by every key in this batch
+	keys      []TKey
+	data      []TValue
+	errors    []error
+	done      []chan struct{} // channels to notify if any of each keys in this batch has been resolved
+	allDone   chan struct{}   // channel to notify that all keys in this batch has been resolved
+	closing   bool            // flags this batch as closed, no more keys can be added in this batch
+	queued    bool            // flags this batch as waiting for a free slot to be resolved
+	wait      time.Duration   // how long the batch waits for keys before being dispatched
+	deadline  time.Time       // the time when the batch will be dispatched by the scheduler
+	heapIndex int             // position of the batch in the scheduler queue, -1 if it is not scheduled
 }
 
-// keyIndex will return the location of the key in the batch, if its not found
-// it will add the key to the batch, if it is the first key in the batch, then the
-// batch timer will be started
-func (b *batch[TKey, TValue]) keyIndex(l *Batcher[TKey, TValue], key TKey) int {
-	for i, existingKey := range b.keys {
-		if key == existingKey {
-			return i
-		}
-	}
-
+// add a key with a new done channel to the batch and return its location, if it is the first key in the batch, then the
+// batch will be scheduled to be dispatched, must be called while holding the batcher lock
+func (b *batch[TKey, TValue]) addKey(l *Batcher[TKey, TValue], key TKey) int {
 	pos := len(b.keys)
 	b.keys = append(b.keys, key)
 	b.done = append(b.done, make(chan struct{}))
+	l.recordArrival()
 	if pos == 0 {
-		go b.startTimer(l)
+		if l.dispatchImmediately && l.inFlight == 0 {
+			l.dispatch(b)
+			return pos
+		}
+		l.schedule(b)
 	}
 
 	if l.maxBatch != 0 && pos >= l.maxBatch-1 {
-		if !b.closing {
-			b.closing = true
-			l.pendingBatch = nil
-			go b.resolveBatch(l)
-		}
+		l.dispatch(b)
 	}
 
 	return pos
 }
 
-func (b *batch[TKey, TValue]) startTimer(l *Batcher[TKey, TValue]) {
-	time.Sleep(l.wait)
-	l.mu.Lock()
-
-	// hit a batch limit and are already finalizing this batch
-	if b.closing {
-		l.mu.Unlock()
-		return
-	}
-
-	l.pendingBatch = nil
-	l.mu.Unlock()
-
-	b.resolveBatch(l)
-}
-
 func (b *batch[TKey, TValue]) resolveBatch(l *Batcher[TKey, TValue]) {
+	l.onDispatch(b.keys, b.wait)
 	b.data = make([]TValue, len(b.keys))
 	b.errors = make([]error, len(b.keys))
-	l.resolver(b.keys, b.finishKey)
+	start := time.Now()
+	l.resolver(b.keys, b.options, b.finishKey)
 	close(b.allDone)
 	l.mu.Lock()
+	l.inFlight--
+	l.latency.observe(time.Since(start))
+	l.startWaiting()
 	for _, key := range b.keys {
-		delete(l.batches, key)
+		k := batchKey[TKey]{key: key, options: b.options}
+		if l.batches[k].batch == b {
+			delete(l.batches, k)
+		}
 	}
 	l.mu.Unlock()
 }
 
+// fail every key of a batch that will not be resolved, must be called while holding the batcher lock
+func (b *batch[TKey, TValue]) fail(err error) {
+	b.data = make([]TValue, len(b.keys))
+	b.errors = make([]error, len(b.keys))
+	for i := range b.keys {
+		b.finishKey(i, zero[TValue](), err)
+	}
+	close(b.allDone)
+}
+
 func (b *batch[TKey, TValue]) finishKey(index int, value TValue, err error) {
 	b.data[index] = value
 	b.errors[index] = err
 	close(b.done[index])
 }
+
+// get the result of the key in the given index, must only be called after the key is resolved
+func (b *batch[TKey, TValue]) result(index int) (TValue, error) {
+	var data TValue
+	if index < len(b.data) {
+		data = b.data[index]
+	}
+
+	var err error
+	if len(b.errors) == 1 {
+		err = b.errors[0]
+	} else if b.errors != nil {
+		err = b.errors[index]
+	}
+
+	return data, err
+}
@@ -3,6 +3,8 @@ package lapis
 import (
 	"sync"
 	"time"
+
+	"github.com/flowscan/lapis/internal/fallback"
 )
 
 // Configuration for the batcher
@@ -12,113 +14,233 @@ type BatcherConfig[TKey comparable, TValue any] struct {
 
 	// MaxBatch will limit the maximum number of keys to send in one batch, 0 = not limit
 	MaxBatch int
+
+	// Adaptive enables tuning the wait duration between MinWait and MaxWait from the arrival rate of keys and
+	// the recent latency of the layers, Wait is used until the latency is known
+	Adaptive bool
+
+	// MinWait is the lower bound of the adaptive wait duration, defaults to 0
+	MinWait time.Duration
+
+	// MaxWait is the upper bound of the adaptive wait duration, defaults to 10 times Wait
+	MaxWait time.Duration
+
+	// DispatchImmediately will send a new batch right away if there are no other batches being resolved
+	DispatchImmediately bool
+
+	// MaxConcurrentBatches limits the number of batches being resolved at the same time, 0 = no limit
+	// Batches that are ready while the limit is reached are queued and keep accepting keys until they are full
+	MaxConcurrentBatches int
+
+	// MaxQueuedBatches limits the number of queued batches, loads that would need a new batch while the limit is
+	// reached will fail with ErrOverloaded, 0 = no limit
+	MaxQueuedBatches int
 }
 
 // Batcher batches and caches requests
 type Batcher[TKey comparable, TValue any] struct {
 	// the resolver for the batched requests
-	resolver func(keys []TKey, finishKey func(index int, value TValue, err error))
+	resolver func(keys []TKey, options loadOptions, finishKey func(index int, value TValue, err error))
 
 	// how long to done before sending a batch
 	wait time.Duration
 
+	// adaptive wait configuration and state
+	adaptive            bool
+	minWait             time.Duration
+	maxWait             time.Duration
+	dispatchImmediately bool
+	lastArrival         time.Time
+	arrivalInterval     ewma // average duration between new keys
+	latency             ewma // average duration to resolve a batch
+
+	// number of batches currently being resolved
+	inFlight int
+
+	// batches waiting for a free slot to be resolved, oldest first
+	waiting []*batch[TKey, TValue]
+
+	// limits of concurrently resolving and queued batches, 0 = no limit
+	maxConcurrentBatches int
+	maxQueuedBatches     int
+
+	// called when a batch is dispatched
+	onDispatch func(keys []TKey, wait time.Duration)
+
 	// this will limit the maximum number of keys to send in one batch, 0 = no limit
 	maxBatch int
 
-	// the current unfinished batch
-	pendingBatch *batch[TKey, TValue]
+	// the current unfinished batches for each set of load options
+	pendingBatches map[loadOptions]*batch[TKey, TValue]
+
+	// a map of keys to the latest active batch that has the key in the batch and the key location in the batch
+	batches map[batchKey[TKey]]batchEntry[TKey, TValue]
+
+	// batches waiting to be dispatched, ordered by their deadline
+	queue batchQueue[TKey, TValue]
 
-	// a map of keys to active batches that has the key in the batch
-	batches map[TKey]*batch[TKey, TValue]
+	// channel to wake the scheduler up when the earliest deadline changes
+	wake chan struct{}
+
+	// channel closed to stop the scheduler, new loads fail with ErrClosed once it is closed
+	closed   chan struct{}
+	isClosed bool
 
 	// mutex to prevent races
 	mu sync.Mutex
 
 	// default load flags
 	defaultLoadFlags LoadFlag
+
+	// identifiers of the store layers, used to resolve load options
+	layerIdentifiers []string
+}
+
+// keys are only shared between batches with the same load options
+type batchKey[TKey comparable] struct {
+	key     TKey
+	options loadOptions
+}
+
+// location of a key in a batch
+type batchEntry[TKey comparable, TValue any] struct {
+	batch *batch[TKey, TValue]
+	index int
+}
+
+// create a new batcher and start its scheduler
+func newBatcher[TKey comparable, TValue any](
+	config BatcherConfig[TKey, TValue],
+	resolver func(keys []TKey, options loadOptions, finishKey func(index int, value TValue, err error)),
+	defaultLoadFlags LoadFlag,
+	layerIdentifiers []string,
+	onDispatch func(keys []TKey, wait time.Duration),
+) *Batcher[TKey, TValue] {
+	wait := fallback.Zero(config.Wait, 1*time.Millisecond)
+	l := &Batcher[TKey, TValue]{
+		resolver:             resolver,
+		wait:                 wait,
+		maxBatch:             fallback.Zero(config.MaxBatch, 256),
+		adaptive:             config.Adaptive,
+		minWait:              config.MinWait,
+		maxWait:              fallback.Zero(config.MaxWait, 10*wait),
+		dispatchImmediately:  config.DispatchImmediately,
+		maxConcurrentBatches: config.MaxConcurrentBatches,
+		maxQueuedBatches:     config.MaxQueuedBatches,
+		pendingBatches:       make(map[loadOptions]*batch[TKey, TValue]),
+		batches:              make(map[batchKey[TKey]]batchEntry[TKey, TValue]),
+		wake:                 make(chan struct{}, 1),
+		closed:               make(chan struct{}),
+		defaultLoadFlags:     defaultLoadFlags,
+		layerIdentifiers:     layerIdentifiers,
+		onDispatch:           onDispatch,
+	}
+	go l.runScheduler()
+	return l
 }
 
 // Load a value by key, batching and caching will be applied automatically
-func (l *Batcher[TKey, TValue]) Load(key TKey) (TValue, error) {
-	return l.LoadThunk(key)()
+func (l *Batcher[TKey, TValue]) Load(key TKey, options ...LoadOption) (TValue, error) {
+	return l.LoadThunk(key, options...)()
 }
 
 // LoadThunk returns a function that when called will block the thread until the requested data is resolved
 // This method should be used if you want one goroutine to make requests to many
 // different data loaders without blocking until the thunk is called.
-func (l *Batcher[TKey, TValue]) LoadThunk(key TKey, flags ...LoadFlag) func() (TValue, error) {
-	var currentBatch *batch[TKey, TValue]
+func (l *Batcher[TKey, TValue]) LoadThunk(key TKey, options ...LoadOption) func() (TValue, error) {
+	return l.loadFuture(key, newLoadOptions(l.defaultLoadFlags, l.layerIdentifiers, options)).Get
+}
+
+func (l *Batcher[TKey, TValue]) loadFuture(key TKey, options loadOptions) *Future[TValue] {
+	k := batchKey[TKey]{key: key, options: options}
 	l.mu.Lock()
+	if l.isClosed {
+		l.mu.Unlock()
+		return failedFuture[TValue](ErrClosed)
+	}
 
 	// priority of batch to be used:
-	// (1) existing batch with the same key
+	// (1) existing batch with the same key, batches that are already being resolved are not used with LoadNoShareBatch
 	// (2) pending batch
 	// (3) create a new batch
-	if existingBatch, ok := l.batches[key]; !hasLoadFlag(l.defaultLoadFlags, flags, LoadNoShareBatch) && ok {
-		currentBatch = existingBatch
-	} else {
-		if l.pendingBatch != nil {
-			currentBatch = l.pendingBatch
-		} else {
-			currentBatch = &batch[TKey, TValue]{allDone: make(chan struct{})}
-			l.pendingBatch = currentBatch
+	entry, ok := l.batches[k]
+	if !ok || (entry.batch.closing && options.has(LoadNoShareBatch)) {
+		currentBatch, ok := l.pendingBatches[options]
+		if !ok {
+			if l.overloaded() {
+				l.mu.Unlock()
+				return failedFuture[TValue](ErrOverloaded)
+			}
+			currentBatch = &batch[TKey, TValue]{options: options, allDone: make(chan struct{}), heapIndex: -1}
+			l.pendingBatches[options] = currentBatch
 		}
-		l.batches[key] = currentBatch
+		entry = batchEntry[TKey, TValue]{batch: currentBatch, index: currentBatch.addKey(l, key)}
+		l.batches[k] = entry
 	}
-
-	index := currentBatch.keyIndex(l, key)
+	done := entry.batch.done[entry.index]
 	l.mu.Unlock()
 
-	return func() (TValue, error) {
-		<-currentBatch.done[index]
+	return newFuture[TValue](done, entry.batch, entry.index)
+}
 
-		var data TValue
-		if index < len(currentBatch.data) {
-			data = currentBatch.data[index]
-		}
+// Stop the scheduler, batches that are not being resolved yet fail with ErrClosed and so do later loads
+// Batches that are already being resolved are left to finish
+func (l *Batcher[TKey, TValue]) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed {
+		return nil
+	}
+	l.isClosed = true
+	close(l.closed)
 
-		var err error
-		if len(currentBatch.errors) == 1 {
-			err = currentBatch.errors[0]
-		} else if currentBatch.errors != nil {
-			err = currentBatch.errors[index]
+	unresolved := append(append([]*batch[TKey, TValue](nil), l.queue...), l.waiting...)
+	for _, b := range l.pendingBatches {
+		unresolved = append(unresolved, b)
+	}
+	l.queue = nil
+	l.waiting = nil
+	for _, b := range unresolved {
+		if b.closing {
+			continue
+		}
+		b.closing = true
+		l.removePendingBatch(b)
+		b.fail(ErrClosed)
+		for _, key := range b.keys {
+			k := batchKey[TKey]{key: key, options: b.options}
+			if l.batches[k].batch == b {
+				delete(l.batches, k)
+			}
 		}
+	}
+	return nil
+}
 
-		return data, err
+// stop adding keys into the given batch, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) removePendingBatch(b *batch[TKey, TValue]) {
+	if l.pendingBatches[b.options] == b {
+		delete(l.pendingBatches, b.options)
 	}
 }
 
 // LoadAll fetches many keys at once. It will be broken into appropriate sized
 // sub batches depending on how the loader is configured
-func (l *Batcher[TKey, TValue]) LoadAll(keys []TKey) ([]TValue, []error) {
-	results := make([]func() (TValue, error), len(keys))
-
-	for i, key := range keys {
-		results[i] = l.LoadThunk(key)
-	}
-
-	result := make([]TValue, len(keys))
-	errors := make([]error, len(keys))
-	for i, thunk := range results {
-		result[i], errors[i] = thunk()
-	}
-	return result, errors
+func (l *Batcher[TKey, TValue]) LoadAll(keys []TKey, options ...LoadOption) ([]TValue, []error) {
+	return l.loadAllFuture(keys, newLoadOptions(l.defaultLoadFlags, l.layerIdentifiers, options)).Get()
 }
 
 // LoadAllThunk returns a function that when called will block waiting for values
 // This method should be used if you want one goroutine to make requests to many
 // different data loaders without blocking until the thunk is called.
-func (l *Batcher[TKey, TValue]) LoadAllThunk(keys []TKey) func() ([]TValue, []error) {
-	results := make([]func() (TValue, error), len(keys))
+func (l *Batcher[TKey, TValue]) LoadAllThunk(keys []TKey, options ...LoadOption) func() ([]TValue, []error) {
+	return l.loadAllFuture(keys, newLoadOptions(l.defaultLoadFlags, l.layerIdentifiers, options)).Get
+}
+
+func (l *Batcher[TKey, TValue]) loadAllFuture(keys []TKey, options loadOptions) Futures[TValue] {
+	futures := make(Futures[TValue], len(keys))
 	for i, key := range keys {
-		results[i] = l.LoadThunk(key)
-	}
-	return func() ([]TValue, []error) {
-		values := make([]TValue, len(keys))
-		errors := make([]error, len(keys))
-		for i, thunk := range results {
-			values[i], errors[i] = thunk()
-		}
-		return values, errors
+		futures[i] = l.loadFuture(key, options)
 	}
+	return futures
 }
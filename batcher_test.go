@@ -0,0 +1,266 @@
+package lapis_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/stretchr/testify/assert"
+)
+
+// benchmark concurrent callers loading distinct keys through the batcher with a backend without latency
+func BenchmarkBatcher(b *testing.B) {
+	for _, callers := range []int{10000, 50000, 100000} {
+		b.Run(fmt.Sprintf("callers=%d", callers), func(b *testing.B) {
+			benchmarkBatcher(b, callers, 1024, time.Millisecond)
+		})
+	}
+}
+
+// benchmark concurrent callers collected into a single large batch
+func BenchmarkBatcherLargeBatch(b *testing.B) {
+	for _, callers := range []int{10000, 50000, 100000} {
+		b.Run(fmt.Sprintf("callers=%d", callers), func(b *testing.B) {
+			benchmarkBatcher(b, callers, callers, 50*time.Millisecond)
+		})
+	}
+}
+
+// benchmark concurrent callers loading the same few keys, only the first load of a key allocates its done channel
+func BenchmarkBatcherDuplicateKeys(b *testing.B) {
+	for _, keys := range []int{1, 100} {
+		b.Run(fmt.Sprintf("keys=%d", keys), func(b *testing.B) {
+			benchmarkBatcherKeys(b, 10000, keys, 1024, time.Millisecond)
+		})
+	}
+}
+
+func benchmarkBatcher(b *testing.B, callers int, maxBatch int, wait time.Duration) {
+	benchmarkBatcherKeys(b, callers, 0, maxBatch, wait)
+}
+
+// keys limits the number of distinct keys loaded per iteration, 0 = every caller loads its own key
+func benchmarkBatcherKeys(b *testing.B, callers int, keys int, maxBatch int, wait time.Duration) {
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "BenchmarkBatcher",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: maxBatch,
+			Wait:     wait,
+		},
+		Layers: []lapis.Layer[int, int]{
+			SquareMockBackend{},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wg := sync.WaitGroup{}
+		wg.Add(callers)
+		for j := 0; j < callers; j++ {
+			capturedIndex := i*callers + j
+			if keys > 0 {
+				capturedIndex = i*keys + j%keys
+			}
+			go func() {
+				defer wg.Done()
+				store.Load(capturedIndex)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestDispatchImmediately(t *testing.T) {
+	recorder := &BatchRecorder{}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestDispatchImmediately",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch:            256,
+			Wait:                time.Hour,
+			DispatchImmediately: true,
+		},
+		Layers: []lapis.Layer[int, int]{
+			SquareMockBackend{},
+		},
+		Extensions: []lapis.Extension{recorder},
+	})
+	assert.Nil(t, err)
+
+	res, err := store.Load(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, res)
+	size, wait := recorder.Last()
+	assert.Equal(t, 1, size)
+	assert.Equal(t, time.Duration(0), wait)
+}
+
+func TestAdaptiveWait(t *testing.T) {
+	recorder := &BatchRecorder{}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestAdaptiveWait",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 100,
+			Wait:     30 * time.Millisecond,
+			Adaptive: true,
+			MinWait:  time.Millisecond,
+			MaxWait:  50 * time.Millisecond,
+		},
+		Layers: []lapis.Layer[int, int]{
+			SquareMockBackend{fakeDelay: 10 * time.Millisecond},
+		},
+		Extensions: []lapis.Extension{recorder},
+	})
+	assert.Nil(t, err)
+
+	// the configured wait is used until the latency is known
+	store.Load(1)
+	_, wait := recorder.Last()
+	assert.Equal(t, 30*time.Millisecond, wait)
+
+	// keys arriving slower than the maximum wait are not worth waiting for
+	time.Sleep(100 * time.Millisecond)
+	store.Load(2)
+	_, wait = recorder.Last()
+	assert.Equal(t, time.Millisecond, wait)
+
+	// filling a batch at a key every 2ms takes about 200ms, so the wait is the layer latency of about 10ms
+	loadSteadily(store, 100, 30, 2*time.Millisecond)
+	_, wait = recorder.Last()
+	assert.GreaterOrEqual(t, wait, 10*time.Millisecond)
+	assert.Less(t, wait, 25*time.Millisecond)
+
+	// with small batches the wait is the time to fill a batch, which is shorter than the layer latency
+	recorder = &BatchRecorder{}
+	store, err = lapis.New(lapis.Config[int, int]{
+		Identifier: "TestAdaptiveWaitFill",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 5,
+			Wait:     80 * time.Millisecond,
+			Adaptive: true,
+			MinWait:  time.Millisecond,
+			MaxWait:  200 * time.Millisecond,
+		},
+		Layers: []lapis.Layer[int, int]{
+			SquareMockBackend{fakeDelay: 100 * time.Millisecond},
+		},
+		Extensions: []lapis.Extension{recorder},
+	})
+	assert.Nil(t, err)
+
+	store.Load(1)
+	loadSteadily(store, 100, 30, 2*time.Millisecond)
+	_, wait = recorder.Last()
+	assert.GreaterOrEqual(t, wait, 10*time.Millisecond)
+	assert.Less(t, wait, 50*time.Millisecond)
+}
+
+func TestMaxConcurrentBatches(t *testing.T) {
+	backend := &ConcurrencyTrackingBackend{fakeDelay: 20 * time.Millisecond}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestMaxConcurrentBatches",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch:             10,
+			MaxConcurrentBatches: 2,
+		},
+		Layers: []lapis.Layer[int, int]{backend},
+	})
+	assert.Nil(t, err)
+
+	n := 200
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		capturedIndex := i
+		go func() {
+			defer wg.Done()
+			res, err := store.Load(capturedIndex)
+			assert.Nil(t, err)
+			assert.Equal(t, capturedIndex, res)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backend.max))
+}
+
+func TestLoadShedding(t *testing.T) {
+	backend := &ConcurrencyTrackingBackend{fakeDelay: 100 * time.Millisecond}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestLoadShedding",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch:             10,
+			MaxConcurrentBatches: 1,
+			MaxQueuedBatches:     1,
+		},
+		Layers: []lapis.Layer[int, int]{backend},
+	})
+	assert.Nil(t, err)
+
+	values, errors := store.LoadAll(generateKeys(100))
+	overloaded := 0
+	for i := range values {
+		if errors[i] == lapis.ErrOverloaded {
+			overloaded++
+		} else {
+			assert.Nil(t, errors[i])
+			assert.Equal(t, i, values[i])
+		}
+	}
+
+	// one batch is resolving and one is queued, the rest are shed
+	assert.Equal(t, 80, overloaded)
+}
+
+func TestBatcherClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestBatcherClose",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 10,
+			Wait:     time.Hour,
+		},
+		Layers: []lapis.Layer[int, int]{&CountingBackend{}},
+	})
+	assert.Nil(t, err)
+
+	// the pending batch fails instead of waiting for its deadline
+	future := store.LoadFuture(1)
+	assert.Nil(t, store.Close())
+	_, err = future.Get()
+	assert.Equal(t, lapis.ErrClosed, err)
+	_, err = store.Load(2)
+	assert.Equal(t, lapis.ErrClosed, err)
+	assert.Nil(t, store.Close())
+
+	// the scheduler goroutine exits
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+}
+
+// load n keys starting from the given key with one key arriving every interval, and wait for all of them
+func loadSteadily(store *lapis.Store[int, int], from int, n int, interval time.Duration) {
+	futures := make([]lapis.Awaitable, n)
+	for i := range futures {
+		futures[i] = store.LoadFuture(from + i)
+		time.Sleep(interval)
+	}
+	lapis.Wait(context.Background(), futures...)
+}
+
+func generateKeys(n int) []int {
+	keys := make([]int, n)
+	for i := range keys {
+		keys[i] = i
+	}
+	return keys
+}
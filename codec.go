@@ -0,0 +1,42 @@
+package lapis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec converts values to and from bytes for layers storing values outside of the process memory
+type Codec interface {
+	// Encode a value into bytes
+	Marshal(value any) ([]byte, error)
+
+	// Decode bytes produced by Marshal into the value pointed to by target
+	Unmarshal(data []byte, target any) error
+}
+
+// GobCodec encodes values with encoding/gob, it is the default codec of the layers
+type GobCodec struct{}
+
+func (GobCodec) Marshal(value any) ([]byte, error) {
+	b := bytes.Buffer{}
+	if err := gob.NewEncoder(&b).Encode(value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, target any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(target)
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec) Unmarshal(data []byte, target any) error {
+	return json.Unmarshal(data, target)
+}
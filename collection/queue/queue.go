@@ -2,6 +2,8 @@ package queue
 
 import (
 	"sync"
+
+	"github.com/flowscan/lapis/internal/fallback"
 )
 
 type Queue[T any] struct {
@@ -15,7 +17,7 @@ type Queue[T any] struct {
 
 // creates a new queue with the given capacity
 func NewQueue[T any](cap int) *Queue[T] {
-	cap = zeroFallback(cap, 1)
+	cap = fallback.Zero(cap, 1)
 	b := &Queue[T]{}
 	b.arr = make([]T, cap)
 	b.cap = cap
@@ -101,11 +103,3 @@ func wrap(n int, cap int) int {
 	}
 	return n % cap
 }
-
-func zeroFallback[T comparable](v T, d T) T {
-	var zeroValue T
-	if v == zeroValue {
-		return d
-	}
-	return v
-}
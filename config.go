@@ -1,5 +1,7 @@
 package lapis
 
+import "time"
+
 // Configuration for a store
 type Config[TKey comparable, TValue any] struct {
 	// Identifier for this store
@@ -19,4 +21,60 @@ type Config[TKey comparable, TValue any] struct {
 
 	// Array of extensions to be used
 	Extensions []Extension
+
+	// Version extracts the version of a value, such as an updated_at timestamp or a sequence number
+	// If set, values are written with their version into layers implementing EntryLayer, which only accept
+	// values newer than the ones they hold, preventing loads that started before a set from overwriting it
+	Version func(value TValue) int64
+
+	// Tags extracts the tags of a value, such as the identifiers of the entities a derived value depends on
+	// If set, values are written with their tags into layers implementing EntryLayer, and every value carrying a
+	// tag can be evicted from the layers implementing TagLayer with InvalidateTag
+	Tags func(key TKey, value TValue) []string
+
+	// Configuration for loading from layers implementing LeaseLayer
+	Lease LeaseConfig
+
+	// Configuration for writing to the final layer, the final layer must implement Writer if a write mode is set
+	Write WriteConfig
+}
+
+// Configuration for lease-based cache filling
+type LeaseConfig struct {
+	// How long to wait before retrying keys that are being loaded by another loader, defaults to 10ms
+	Wait time.Duration
+
+	// How many times keys that are being loaded by another loader are retried before loading them from the
+	// next layers, defaults to 10, set a negative value to never retry
+	Retries int
+}
+
+// Mode of writing values to the final layer
+type WriteMode int
+
+const (
+	WriteNone    WriteMode = iota // Set only primes the layers, the final layer's Set is called like any other layer
+	WriteThrough                  // Set writes to the final layer first and only primes the caches with the values written successfully
+	WriteBehind                   // Set primes the caches and queues the write to the final layer, queued writes are batched and retried
+)
+
+// Configuration for writes to the final layer
+type WriteConfig struct {
+	// Mode of writing values to the final layer, defaults to WriteNone
+	Mode WriteMode
+
+	// Maximum number of queued writes sent to the final layer at once, defaults to 256
+	MaxBatch int
+
+	// How long to collect queued writes before sending them to the final layer, defaults to 10ms
+	Wait time.Duration
+
+	// How many times failed queued writes are retried, defaults to 3, set a negative value to never retry
+	Retries int
+
+	// How long to wait before retrying failed queued writes, doubled after each retry, defaults to 100ms
+	RetryWait time.Duration
+
+	// Maximum number of queued writes, writes that would exceed the limit fail with ErrOverloaded, 0 = no limit
+	MaxQueued int
 }
@@ -0,0 +1,171 @@
+package lapis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// Prefix of the tags identifying derived values by their key
+const DerivedTagPrefix = "__lapis_derived:"
+
+// Dependency of a derived store on the values of another store
+type Dependency[TKey comparable] struct {
+	watch func(invalidate func(keys []TKey))
+}
+
+// Declare that derived values are computed from the values of a store, keys returns the keys of the derived values
+// computed from a key of the store, which are invalidated when the key is set or written
+func DependsOn[TKey comparable, TDependencyKey comparable, TDependencyValue any](store *Store[TDependencyKey, TDependencyValue], keys func(key TDependencyKey) []TKey) Dependency[TKey] {
+	return Dependency[TKey]{
+		watch: func(invalidate func(keys []TKey)) {
+			store.watch(func(dependencyKeys []TDependencyKey) {
+				var derivedKeys []TKey
+				for _, key := range dependencyKeys {
+					derivedKeys = append(derivedKeys, keys(key)...)
+				}
+				if len(derivedKeys) > 0 {
+					invalidate(derivedKeys)
+				}
+			})
+		},
+	}
+}
+
+// number of counters of the invalidations of derived values, keys sharing a counter are checked together
+const derivedGenerationCount = 256
+
+// counters of the invalidations of derived values, used to detect values invalidated while being computed
+type derivedGenerations [derivedGenerationCount]uint64
+
+// Create a store of values computed from other stores, the configured layers cache the computed values and compute
+// is the final layer, called with whole batches so the loads of each dependency can be batched with LoadAll
+// Changes made through the dependency stores evict the affected values from the layers and invalidate the stores
+// derived from this store in turn, values being computed during a change are evicted once primed
+// The layers must implement TagLayer and EntryLayer, the derived values are tagged through SetEntries, otherwise
+// ErrUntaggedLayer is returned
+func Derive[TKey comparable, TValue any](config Config[TKey, TValue], compute func(keys []TKey) ([]TValue, []error), dependencies ...Dependency[TKey]) (*Store[TKey, TValue], error) {
+	for _, layer := range config.Layers {
+		_, tagged := layer.(TagLayer)
+		_, entries := layer.(EntryLayer[TKey, TValue])
+		if !tagged || !entries {
+			return nil, ErrUntaggedLayer{Layer: layer.Identifier()}
+		}
+	}
+	layers := make([]Layer[TKey, TValue], len(config.Layers), len(config.Layers)+1)
+	copy(layers, config.Layers)
+	config.Layers = append(layers, funcLayer[TKey, TValue]{identifier: "derived", load: compute})
+
+	// tag the values with their keys so they can be evicted
+	tags := config.Tags
+	config.Tags = func(key TKey, value TValue) []string {
+		derivedTags := []string{derivedTag(key)}
+		if tags != nil {
+			derivedTags = append(derivedTags, tags(key, value)...)
+		}
+		return derivedTags
+	}
+
+	r, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	r.generations = &derivedGenerations{}
+	for _, dependency := range dependencies {
+		dependency.watch(r.invalidateDerived)
+	}
+	return r, nil
+}
+
+// evict derived values and notify the stores derived from this store
+// errors of the layers are ignored since the change has already been applied to the dependency
+// the generations are incremented before the eviction so values primed concurrently are evicted again
+func (r *Store[TKey, TValue]) invalidateDerived(keys []TKey) {
+	tags := make([]string, len(keys))
+	for i, key := range keys {
+		tags[i] = derivedTag(key)
+		atomic.AddUint64(r.generations.of(tags[i]), 1)
+	}
+	r.InvalidateTags(tags)
+	r.notify(keys)
+}
+
+// get the generations of the keys before they are resolved, nil if the store is not derived
+func (r *Store[TKey, TValue]) derivedGenerations(keys []TKey) []uint64 {
+	if r.generations == nil {
+		return nil
+	}
+	generations := make([]uint64, len(keys))
+	for i, key := range keys {
+		generations[i] = atomic.LoadUint64(r.generations.of(derivedTag(key)))
+	}
+	return generations
+}
+
+// evict primed values whose keys were invalidated since they started being resolved, the invalidation may have run
+// before the values were primed, generations are indexed by the result indexes
+func (r *Store[TKey, TValue]) evictInvalidated(traceID uint64, layerIndex int, generations []uint64, resultIndexes []int, keys []TKey) {
+	if generations == nil {
+		return
+	}
+	tagLayer, ok := r.layers[layerIndex].(TagLayer)
+	if !ok {
+		return
+	}
+	var tags []string
+	for i, key := range keys {
+		tag := derivedTag(key)
+		if atomic.LoadUint64(r.generations.of(tag)) != generations[resultIndexes[i]] {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		r.layerInvalidateTags(traceID, layerIndex, tagLayer, tags)
+	}
+}
+
+// get the counter of a derived tag
+func (g *derivedGenerations) of(tag string) *uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+	return &g[h.Sum32()%derivedGenerationCount]
+}
+
+// register a function called with the keys of every set or write
+func (r *Store[TKey, TValue]) watch(watcher func(keys []TKey)) {
+	r.watchersMu.Lock()
+	defer r.watchersMu.Unlock()
+	r.watchers = append(r.watchers, watcher)
+}
+
+// call the watchers with the changed keys
+func (r *Store[TKey, TValue]) notify(keys []TKey) {
+	r.watchersMu.RLock()
+	watchers := r.watchers
+	r.watchersMu.RUnlock()
+	for _, watcher := range watchers {
+		watcher(keys)
+	}
+}
+
+// get the tag identifying a derived value
+func derivedTag[TKey any](key TKey) string {
+	return fmt.Sprintf("%s%v", DerivedTagPrefix, key)
+}
+
+// a final layer loading values with a function, used by derived, list, and query stores
+type funcLayer[TKey comparable, TValue any] struct {
+	identifier string
+	load       func(keys []TKey) ([]TValue, []error)
+}
+
+func (l funcLayer[TKey, TValue]) Identifier() string { return l.identifier }
+
+func (l funcLayer[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	return l.load(keys)
+}
+
+// the values are only loaded by the function, so primed values are ignored
+func (l funcLayer[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	return nil
+}
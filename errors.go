@@ -1,10 +1,14 @@
 package lapis
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Indicates that the given key is not able to be resolved
 type ErrNotFound[TKey any] struct {
-	key TKey
+	key           TKey
+	authoritative bool
 }
 
 func (m ErrNotFound[TKey]) Error() string {
@@ -16,3 +20,59 @@ func NewErrNotFound[TKey any](key TKey) ErrNotFound[TKey] {
 		key: key,
 	}
 }
+
+// Create an error for a key that is known to not exist, layers return it so the key is not loaded from the next layers
+func NewErrAuthoritativeNotFound[TKey any](key TKey) ErrNotFound[TKey] {
+	return ErrNotFound[TKey]{
+		key:           key,
+		authoritative: true,
+	}
+}
+
+// Check if the key is known to not exist, in which case it was not loaded from the next layers
+func (m ErrNotFound[TKey]) Authoritative() bool {
+	return m.authoritative
+}
+
+// Indicates that the load was rejected because too many batches are waiting to be resolved
+var ErrOverloaded = errors.New("lapis: too many batches are waiting to be resolved")
+
+// Indicates that the load was rejected or abandoned because the store was closed
+var ErrClosed = errors.New("lapis: the store is closed")
+
+// Indicates that a layer or an extension hook panicked while handling the key
+type ErrLayerPanic struct {
+	Layer     string // identifier of the panicking layer or of the store if it is not caused by a layer, empty if the panic comes from an extension
+	Extension string // name of the panicking extension, empty if the panic comes from a layer
+	Value     any    // the recovered panic value
+	Stack     []byte // stack trace of the panic
+}
+
+func (m ErrLayerPanic) Error() string {
+	if m.Extension != "" {
+		return fmt.Sprintf("panic in extension %s: %v", m.Extension, m.Value)
+	}
+	return fmt.Sprintf("panic in layer %s: %v", m.Layer, m.Value)
+}
+
+// Indicates that a cache layer of a derived store does not implement both TagLayer and EntryLayer, so its values could
+// not be tagged and evicted when the dependencies change
+type ErrUntaggedLayer struct {
+	Layer string // identifier of the layer
+}
+
+func (m ErrUntaggedLayer) Error() string {
+	return fmt.Sprintf("lapis: layer %s of a derived store does not implement TagLayer and EntryLayer", m.Layer)
+}
+
+// Indicates that a versioned write was rejected because the layer already holds a newer or equal version
+var ErrStaleVersion = errors.New("lapis: the stored value has a newer version")
+
+// Indicates that the key is missing and another loader holds the lease to fill it
+var ErrHotMiss = errors.New("lapis: the key is being loaded by another loader")
+
+// Indicates that a leased write was rejected because the lease has expired or has been revoked by another write
+var ErrInvalidLease = errors.New("lapis: the lease is no longer valid")
+
+// Indicates that values can't be written because no write mode is configured or the final layer does not implement Writer
+var ErrNotWritable = errors.New("lapis: the store is not configured for writes")
@@ -1,5 +1,7 @@
 package lapis
 
+import "time"
+
 // Extension interface is the base interface used for extensions
 type Extension interface {
 	Name() string // The extension name
@@ -56,3 +58,15 @@ type LayerPreSetHookExtension[TKey comparable, TValue any] interface {
 type LayerPostSetHookExtension[TKey comparable, TValue any] interface {
 	LayerPostSetHook(traceID uint64, layerIndex int, keys []TKey, values []TValue, errors []error)
 }
+
+// Extensions that hook when the batcher dispatches a batch to be resolved
+// wait is the duration the batch waited for keys before being dispatched, which may be tuned by the adaptive batcher
+type BatchDispatchHookExtension[TKey comparable, TValue any] interface {
+	BatchDispatchHook(keys []TKey, wait time.Duration)
+}
+
+// Extensions that hook when a layer or an extension hook panics, the panic is recovered and
+// returned as an ErrLayerPanic error for all of the affected keys
+type PanicHookExtension[TKey comparable, TValue any] interface {
+	PanicHook(traceID uint64, err ErrLayerPanic)
+}
@@ -100,3 +100,11 @@ func (e *Logger[TKey, TValue]) LayerPostSetHook(traceID uint64, layerIndex int,
 	delete(e.loggerLayerSetStartAt[layerIndex], traceID)
 	e.loggerMu.Unlock()
 }
+
+func (e *Logger[TKey, TValue]) BatchDispatchHook(keys []TKey, wait time.Duration) {
+	e.logger.Debug().Msgf("batch dispatched after waiting %v: %v", wait, keys)
+}
+
+func (e *Logger[TKey, TValue]) PanicHook(traceID uint64, err lapis.ErrLayerPanic) {
+	e.logger.Error().Uint64("trace", traceID).Str("stack", string(err.Stack)).Msg(err.Error())
+}
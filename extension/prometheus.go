@@ -25,6 +25,7 @@ type StoreMetrics struct {
 	LayerLoadBatchHistogram *prometheus.HistogramVec
 	LayerSetTimeHistogram   *prometheus.HistogramVec
 	LayerSetBatchHistogram  *prometheus.HistogramVec
+	BatchWaitHistogram      *prometheus.HistogramVec
 }
 
 // Create a new store metric collector
@@ -76,6 +77,12 @@ func NewStoreMetrics(additionalLabels ...string) *StoreMetrics {
 		Name:      "set_batch",
 		Help:      "The batch size for each set on to a layer",
 	}, append(additionalLabels, []string{"store", "layer"}...))
+	c.BatchWaitHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "lapis",
+		Subsystem: "batcher",
+		Name:      "wait_seconds",
+		Help:      "The time a batch waits for keys before being dispatched",
+	}, append(additionalLabels, []string{"store"}...))
 	return c
 }
 
@@ -250,3 +257,7 @@ func (e *PrometheusMetrics[TKey, TValue]) LayerPostSetHook(traceID uint64, layer
 		e.metrics.LayerSetTimeHistogram.WithLabelValues(append(e.labelValues, e.storeName, e.layerIdentifiers[layerIndex], status)...).Observe(traceTime)
 	}
 }
+
+func (e *PrometheusMetrics[TKey, TValue]) BatchDispatchHook(keys []TKey, wait time.Duration) {
+	e.metrics.BatchWaitHistogram.WithLabelValues(append(e.labelValues, e.storeName)...).Observe(wait.Seconds())
+}
@@ -0,0 +1,115 @@
+package lapis
+
+import "context"
+
+// Awaitable is any pending operation that can be waited on, such as futures from different stores
+type Awaitable interface {
+	// Block until the operation is finished or the context is cancelled
+	Wait(ctx context.Context) error
+}
+
+// Wait for all of the given futures to finish, the futures may come from different stores
+// Returns the context error if the context is cancelled before all futures are finished
+func Wait(ctx context.Context, futures ...Awaitable) error {
+	for _, f := range futures {
+		if err := f.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Future is the pending result of a load operation
+type Future[TValue any] struct {
+	done   <-chan struct{}
+	source futureSource[TValue]
+	index  int
+}
+
+// the holder of the results of a set of futures, such as a batch
+type futureSource[TValue any] interface {
+	result(index int) (TValue, error)
+}
+
+func newFuture[TValue any](done <-chan struct{}, source futureSource[TValue], index int) *Future[TValue] {
+	return &Future[TValue]{done: done, source: source, index: index}
+}
+
+// create a future that has already failed with the given error
+func failedFuture[TValue any](err error) *Future[TValue] {
+	done := make(chan struct{})
+	close(done)
+	return newFuture[TValue](done, futureError[TValue]{err: err}, 0)
+}
+
+type futureError[TValue any] struct {
+	err error
+}
+
+func (f futureError[TValue]) result(index int) (TValue, error) {
+	return zero[TValue](), f.err
+}
+
+// Returns a channel that is closed when the result is available
+func (f *Future[TValue]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Block until the result is available
+func (f *Future[TValue]) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Block until the result is available and return it
+func (f *Future[TValue]) Get() (TValue, error) {
+	<-f.done
+	return f.source.result(f.index)
+}
+
+// Block until the result is available and return it, the context error is returned if the context is cancelled first
+// Cancelling the context only stops the waiting, the load operation will still be finished in the background
+func (f *Future[TValue]) GetCtx(ctx context.Context) (TValue, error) {
+	if err := f.Wait(ctx); err != nil {
+		return zero[TValue](), err
+	}
+	return f.source.result(f.index)
+}
+
+// Futures is the pending results of a multi-key load operation
+type Futures[TValue any] []*Future[TValue]
+
+// Block until all of the results are available
+func (f Futures[TValue]) Wait(ctx context.Context) error {
+	for _, future := range f {
+		if err := future.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block until all of the results are available and return them
+func (f Futures[TValue]) Get() ([]TValue, []error) {
+	values := make([]TValue, len(f))
+	errors := make([]error, len(f))
+	for i, future := range f {
+		values[i], errors[i] = future.Get()
+	}
+	return values, errors
+}
+
+// Block until all of the results are available and return them, results that are not available before the
+// context is cancelled will have the context error
+func (f Futures[TValue]) GetCtx(ctx context.Context) ([]TValue, []error) {
+	values := make([]TValue, len(f))
+	errors := make([]error, len(f))
+	for i, future := range f {
+		values[i], errors[i] = future.GetCtx(ctx)
+	}
+	return values, errors
+}
@@ -0,0 +1,10 @@
+package fallback
+
+// Return the fallback if the input is the zero value
+func Zero[T comparable](input T, fallback T) T {
+	var zero T
+	if input == zero {
+		return fallback
+	}
+	return input
+}
@@ -0,0 +1,20 @@
+package lapis
+
+// Evict every value carrying the given tag from the layers implementing TagLayer
+// Returns an array of errors with each item represents an error returned by a layer
+func (r *Store[TKey, TValue]) InvalidateTag(tag string) []error {
+	return r.InvalidateTags([]string{tag})
+}
+
+// Evict every value carrying any of the given tags from the layers implementing TagLayer
+// Returns an array of errors with each item represents an error returned by a layer
+func (r *Store[TKey, TValue]) InvalidateTags(tags []string) []error {
+	traceID := r.getTraceID()
+	errors := make([]error, len(r.layers))
+	for layerIndex, layer := range r.layers {
+		if tagLayer, ok := layer.(TagLayer); ok {
+			errors[layerIndex] = r.layerInvalidateTags(traceID, layerIndex, tagLayer, tags)
+		}
+	}
+	return errors
+}
@@ -1,5 +1,7 @@
 package lapis
 
+import "time"
+
 // Handler is any function that takes a model key and will return the model value
 type Handler[TKey comparable, TValue any] func(key TKey) (TValue, error)
 
@@ -19,3 +21,59 @@ type Layer[TKey comparable, TValue any] interface {
 	// The function that will be called for setting data to be primed that is resolved by the layers after this
 	Set(keys []TKey, values []TValue) []error
 }
+
+// AgeLayer is implemented by layers that are able to report when their values were stored, it is required to
+// serve loads with a maximum acceptable age
+type AgeLayer[TKey comparable, TValue any] interface {
+	// Load values from the given set of keys along with the time each value was stored
+	GetWithTime(keys []TKey) ([]TValue, []time.Time, []error)
+}
+
+// Entry is a value written into a layer along with its metadata
+type Entry[TValue any] struct {
+	// The value to be stored
+	Value TValue
+
+	// Version of the value, a versioned value is only stored if it is newer than the stored version
+	// 0 means the value is not versioned and will always be stored
+	Version int64
+
+	// Lease issued by the layer when the key was missing, a leased value is only stored if the lease is still valid
+	// 0 means the value is not leased and will always be stored, revoking outstanding leases of the key
+	Lease Lease
+
+	// Tags of the value, the value is evicted when any of its tags is invalidated
+	Tags []string
+}
+
+// EntryLayer is implemented by layers that are able to store values along with their metadata, such as versions for
+// conditional writes. Stores use SetEntries instead of Set for these layers when entry metadata is configured.
+type EntryLayer[TKey comparable, TValue any] interface {
+	// Set entries into the layer, entries that are rejected due to an outdated version will have ErrStaleVersion
+	// and entries that are rejected due to an invalid lease will have ErrInvalidLease
+	SetEntries(keys []TKey, entries []Entry[TValue]) []error
+}
+
+// TagLayer is implemented by layers that are able to evict values by the tags they were stored with
+type TagLayer interface {
+	// Evict every value stored with any of the given tags
+	InvalidateTags(tags []string) error
+}
+
+// Writer is implemented by final layers that accept writes to the source of truth, see WriteMode
+type Writer[TKey comparable, TValue any] interface {
+	// Write values to the source of truth, returns an error for each key that failed to be written
+	Write(keys []TKey, values []TValue) []error
+}
+
+// Lease is a token issued by a layer granting the right to fill a missing key, 0 means no lease
+type Lease uint64
+
+// LeaseLayer is implemented by layers that issue leases on misses to prevent thundering herds and stale sets.
+// The first loader missing a key receives a lease to fill it, other loaders receive ErrHotMiss until the key is
+// filled or the lease expires. A leased value is only stored if no other write has revoked the lease since.
+type LeaseLayer[TKey comparable, TValue any] interface {
+	// Load values from the given set of keys, missing keys will either have a lease or ErrHotMiss
+	// Layers with leases disabled return nil leases
+	GetLeased(keys []TKey) ([]TValue, []Lease, []error)
+}
@@ -0,0 +1,174 @@
+package layer
+
+import "github.com/flowscan/lapis"
+
+// Converter converts values between the type of a store and the type of a layer in both directions
+type Converter[TFrom any, TTo any] struct {
+	// Convert a value of the store into a value of the layer
+	To func(from TFrom) (TTo, error)
+
+	// Convert a value of the layer into a value of the store
+	From func(to TTo) (TFrom, error)
+}
+
+// CodecConverter converts values to and from their encoded form with a codec, such as to use a layer storing
+// []byte values under a store of structs
+func CodecConverter[TValue any](codec lapis.Codec) Converter[TValue, []byte] {
+	return Converter[TValue, []byte]{
+		To: func(from TValue) ([]byte, error) {
+			return codec.Marshal(from)
+		},
+		From: func(to []byte) (TValue, error) {
+			var value TValue
+			err := codec.Unmarshal(to, &value)
+			return value, err
+		},
+	}
+}
+
+// MappedKeys presents a layer with keys of another type as a layer with the keys of the store
+// Optional layer interfaces such as lapis.AgeLayer are not forwarded
+type MappedKeys[TKey comparable, TLayerKey comparable, TValue any] struct {
+	layer  lapis.Layer[TLayerKey, TValue]
+	mapKey func(key TKey) (TLayerKey, error)
+}
+
+// Unique identifier for this layer used for logging and metric purposes, the identifier of the wrapped layer is used
+func (l *MappedKeys[TKey, TLayerKey, TValue]) Identifier() string { return l.layer.Identifier() }
+
+// The function that will be used to resolve a set of keys, keys failing to be converted are not loaded
+func (l *MappedKeys[TKey, TLayerKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	indexes, layerKeys := l.mapKeys(keys, errors)
+	if len(layerKeys) == 0 {
+		return result, errors
+	}
+	values, layerErrors := l.layer.Get(layerKeys)
+	for j, i := range indexes {
+		result[i] = values[j]
+		if len(layerErrors) > 0 {
+			errors[i] = mapNotFound[TKey, TLayerKey](layerErrors[j], keys[i])
+		}
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, keys failing to be converted are not set
+func (l *MappedKeys[TKey, TLayerKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	errors := make([]error, len(keys))
+	indexes, layerKeys := l.mapKeys(keys, errors)
+	if len(layerKeys) == 0 {
+		return errors
+	}
+	layerValues := make([]TValue, len(indexes))
+	for j, i := range indexes {
+		layerValues[j] = values[i]
+	}
+	layerErrors := l.layer.Set(layerKeys, layerValues)
+	for j, i := range indexes {
+		if len(layerErrors) > 0 {
+			errors[i] = layerErrors[j]
+		}
+	}
+	return errors
+}
+
+// convert the keys into the keys of the layer, the conversion errors are written to the errors array and indexes
+// map the converted keys to the given keys
+func (l *MappedKeys[TKey, TLayerKey, TValue]) mapKeys(keys []TKey, errors []error) ([]int, []TLayerKey) {
+	indexes := make([]int, 0, len(keys))
+	layerKeys := make([]TLayerKey, 0, len(keys))
+	for i, key := range keys {
+		layerKey, err := l.mapKey(key)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		layerKeys = append(layerKeys, layerKey)
+	}
+	return indexes, layerKeys
+}
+
+// MappedValues presents a layer with values of another type as a layer with the values of the store
+// Optional layer interfaces such as lapis.AgeLayer are not forwarded
+type MappedValues[TKey comparable, TValue any, TLayerValue any] struct {
+	layer     lapis.Layer[TKey, TLayerValue]
+	converter Converter[TValue, TLayerValue]
+}
+
+// Unique identifier for this layer used for logging and metric purposes, the identifier of the wrapped layer is used
+func (l *MappedValues[TKey, TValue, TLayerValue]) Identifier() string { return l.layer.Identifier() }
+
+// The function that will be used to resolve a set of keys, values failing to be converted have the conversion error
+func (l *MappedValues[TKey, TValue, TLayerValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	values, errors := l.layer.Get(keys)
+	if len(errors) == 0 {
+		errors = make([]error, len(keys))
+	}
+	for i := range keys {
+		if errors[i] != nil {
+			continue
+		}
+		result[i], errors[i] = l.converter.From(values[i])
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, values failing to be converted are not set
+func (l *MappedValues[TKey, TValue, TLayerValue]) Set(keys []TKey, values []TValue) []error {
+	errors := make([]error, len(keys))
+	indexes := make([]int, 0, len(keys))
+	layerKeys := make([]TKey, 0, len(keys))
+	layerValues := make([]TLayerValue, 0, len(keys))
+	for i, value := range values {
+		layerValue, err := l.converter.To(value)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		layerKeys = append(layerKeys, keys[i])
+		layerValues = append(layerValues, layerValue)
+	}
+	if len(layerKeys) == 0 {
+		return errors
+	}
+	layerErrors := l.layer.Set(layerKeys, layerValues)
+	for j, i := range indexes {
+		if len(layerErrors) > 0 {
+			errors[i] = layerErrors[j]
+		}
+	}
+	return errors
+}
+
+// convert a not found error of a layer key into a not found error of the store key
+func mapNotFound[TKey any, TLayerKey any](err error, key TKey) error {
+	notFound, ok := err.(lapis.ErrNotFound[TLayerKey])
+	if !ok {
+		return err
+	}
+	if notFound.Authoritative() {
+		return lapis.NewErrAuthoritativeNotFound(key)
+	}
+	return lapis.NewErrNotFound(key)
+}
+
+// Wrap a layer with keys of another type, mapKey converts the keys of the store into the keys of the layer
+func MapKeys[TKey comparable, TLayerKey comparable, TValue any](layer lapis.Layer[TLayerKey, TValue], mapKey func(key TKey) (TLayerKey, error)) *MappedKeys[TKey, TLayerKey, TValue] {
+	return &MappedKeys[TKey, TLayerKey, TValue]{
+		layer:  layer,
+		mapKey: mapKey,
+	}
+}
+
+// Wrap a layer with values of another type, the converter converts the values between the store and the layer
+func MapValues[TKey comparable, TValue any, TLayerValue any](layer lapis.Layer[TKey, TLayerValue], converter Converter[TValue, TLayerValue]) *MappedValues[TKey, TValue, TLayerValue] {
+	return &MappedValues[TKey, TValue, TLayerValue]{
+		layer:     layer,
+		converter: converter,
+	}
+}
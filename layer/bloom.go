@@ -0,0 +1,321 @@
+package layer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flowscan/lapis/internal/fallback"
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Filter is a probabilistic set of keys used by the guard layer, it may report keys that were never added as
+// present but never reports added keys as absent
+type Filter interface {
+	// Add keys to the filter
+	Add(keys []string) error
+
+	// Test the keys, false means the key has definitely not been added
+	// Returns ErrFilterNotBuilt if the filter is not built yet, such as a shared filter that no instance has built
+	Test(keys []string) ([]bool, error)
+
+	// Replace the content of the filter with the keys added by fill, keys added while rebuilding are kept
+	Rebuild(fill func(add func(keys []string) error) error) error
+}
+
+// Indicates that a filter is not built yet, so its tests can't be trusted
+var ErrFilterNotBuilt = errors.New("guard layer: the filter is not built")
+
+// Size of a bloom filter
+type BloomConfig struct {
+	// Expected number of keys, defaults to 1,000,000
+	Capacity int
+
+	// Rate of absent keys tested as present once the filter holds its capacity, defaults to 0.01
+	FalsePositiveRate float64
+}
+
+// get the number of bits and hash functions of a bloom filter
+func (c BloomConfig) parameters() (uint64, int) {
+	capacity := float64(fallback.Zero(c.Capacity, 1_000_000))
+	rate := fallback.Zero(c.FalsePositiveRate, 0.01)
+	bits := math.Ceil(-capacity * math.Log(rate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / capacity * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return uint64(bits), hashes
+}
+
+// get the bits of a key in a bloom filter with double hashing
+func bloomPositions(key string, bits uint64, hashes int) []uint64 {
+	h1 := hashString(key)
+	h2 := mix64(h1) | 1
+	positions := make([]uint64, hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bits
+	}
+	return positions
+}
+
+// BloomFilter is an in-memory bloom filter
+type BloomFilter struct {
+	bits     uint64
+	hashes   int
+	words    []uint64
+	building []uint64 // words of the filter being rebuilt, nil if the filter is not being rebuilt
+	built    bool     // whether a rebuild has completed, the filter is not trusted before
+	mu       sync.RWMutex
+}
+
+func (f *BloomFilter) Add(keys []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		for _, position := range bloomPositions(key, f.bits, f.hashes) {
+			f.words[position/64] |= 1 << (position % 64)
+			if f.building != nil {
+				f.building[position/64] |= 1 << (position % 64)
+			}
+		}
+	}
+	return nil
+}
+
+// Test the keys, ErrFilterNotBuilt is returned until the filter is first rebuilt since keys that were never loaded
+// can't be told apart from keys that don't exist
+func (f *BloomFilter) Test(keys []string) ([]bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.built {
+		return nil, ErrFilterNotBuilt
+	}
+	result := make([]bool, len(keys))
+	for i, key := range keys {
+		result[i] = true
+		for _, position := range bloomPositions(key, f.bits, f.hashes) {
+			if f.words[position/64]&(1<<(position%64)) == 0 {
+				result[i] = false
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *BloomFilter) Rebuild(fill func(add func(keys []string) error) error) error {
+	f.mu.Lock()
+	f.building = make([]uint64, len(f.words))
+	f.mu.Unlock()
+
+	err := fill(func(keys []string) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, key := range keys {
+			for _, position := range bloomPositions(key, f.bits, f.hashes) {
+				f.building[position/64] |= 1 << (position % 64)
+			}
+		}
+		return nil
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		f.words = f.building
+		f.built = true
+	}
+	f.building = nil
+	return err
+}
+
+// Create a new in-memory bloom filter
+func NewBloomFilter(config BloomConfig) *BloomFilter {
+	bits, hashes := config.parameters()
+	return &BloomFilter{
+		bits:   bits,
+		hashes: hashes,
+		words:  make([]uint64, (bits+63)/64),
+	}
+}
+
+// Configuration for the redis bloom filter
+type RedisBloomConfig struct {
+	BloomConfig
+
+	// Connection to redis
+	Connection *radix.Pool
+
+	// Redis key of the filter
+	Key string
+
+	// Duration after which a rebuild that stopped making progress, such as the rebuild of a crashed instance, is
+	// abandoned, the timer is reset with every batch of keys, defaults to 1 minute
+	BuildTimeout time.Duration
+}
+
+// RedisBloomFilter is a bloom filter stored as a redis string, which allows sharing the filter across instances
+// The filter is rebuilt into a separate key, the keys being rebuilt are registered in redis so keys added by every
+// instance during a rebuild are kept, which requires a single redis node like tags
+type RedisBloomFilter struct {
+	config RedisBloomConfig
+	bits   uint64
+	hashes int
+}
+
+// Suffix of the redis keys of the filters being rebuilt, followed by a random token of each rebuild
+const RedisBloomBuildSuffix = ":__lapis_build:"
+
+// Suffix of the redis set holding the keys of the filters being rebuilt
+const RedisBloomBuildsSuffix = ":__lapis_builds"
+
+// Sets bits in the filter and in the filters being rebuilt, rebuilds that expired are unregistered
+// KEYS: the filter key and the set of build keys
+// ARGV: positions of the bits
+var redisBloomAddScript = `
+local builds = {}
+for _, build in ipairs(redis.call('SMEMBERS', KEYS[2])) do
+	if redis.call('EXISTS', build) == 1 then
+		builds[#builds + 1] = build
+	else
+		redis.call('SREM', KEYS[2], build)
+	end
+end
+for _, position in ipairs(ARGV) do
+	redis.call('SETBIT', KEYS[1], position, 1)
+	for _, build in ipairs(builds) do
+		redis.call('SETBIT', build, position, 1)
+	end
+end
+return 1
+`
+
+// Replaces the filter with a rebuilt filter unless the rebuild expired
+// KEYS: the filter key, the set of build keys, and the build key
+// Results: 1 = replaced, 0 = expired
+var redisBloomReplaceScript = `
+if redis.call('SREM', KEYS[2], KEYS[3]) == 0 or redis.call('EXISTS', KEYS[3]) == 0 then
+	return 0
+end
+redis.call('PERSIST', KEYS[3])
+redis.call('RENAME', KEYS[3], KEYS[1])
+return 1
+`
+
+// Indicates that a rebuild of a redis filter made no progress for longer than the build timeout
+var ErrRedisBloomBuildExpired = errors.New("guard layer: the rebuild of the redis filter expired")
+
+func (f *RedisBloomFilter) Add(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	arguments := []string{f.config.Key, f.config.Key + RedisBloomBuildsSuffix}
+	for _, key := range keys {
+		for _, position := range bloomPositions(key, f.bits, f.hashes) {
+			arguments = append(arguments, strconv.FormatUint(position, 10))
+		}
+	}
+	return f.config.Connection.Do(radix.NewEvalScript(2, redisBloomAddScript).Cmd(nil, arguments...))
+}
+
+// Test the keys, the bit after the bits of the filter flags that it has been built so a missing or evicted filter
+// is not trusted
+// The bits are read with a single BITFIELD command, the built flag first
+func (f *RedisBloomFilter) Test(keys []string) ([]bool, error) {
+	arguments := make([]string, 0, 1+3*(len(keys)*f.hashes+1))
+	arguments = append(arguments, f.config.Key, "GET", "u1", strconv.FormatUint(f.bits, 10))
+	for _, key := range keys {
+		for _, position := range bloomPositions(key, f.bits, f.hashes) {
+			arguments = append(arguments, "GET", "u1", strconv.FormatUint(position, 10))
+		}
+	}
+	var values []int
+	if err := f.config.Connection.Do(radix.Cmd(&values, "BITFIELD", arguments...)); err != nil {
+		return nil, err
+	}
+	if len(values) != len(keys)*f.hashes+1 {
+		return nil, fmt.Errorf("guard layer: BITFIELD returned %d bits instead of %d", len(values), len(keys)*f.hashes+1)
+	}
+	if values[0] == 0 {
+		return nil, ErrFilterNotBuilt
+	}
+	values = values[1:]
+	result := make([]bool, len(keys))
+	for i := range keys {
+		result[i] = true
+		for _, value := range values[i*f.hashes : (i+1)*f.hashes] {
+			if value == 0 {
+				result[i] = false
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// Rebuild the filter into a separate key and rename it to the key of the filter once complete, concurrent rebuilds
+// use separate keys and the last one to complete replaces the filter
+func (f *RedisBloomFilter) Rebuild(fill func(add func(keys []string) error) error) error {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	buildsKey := f.config.Key + RedisBloomBuildsSuffix
+	buildKey := f.config.Key + RedisBloomBuildSuffix + hex.EncodeToString(token)
+	timeout := strconv.FormatInt(f.config.BuildTimeout.Milliseconds(), 10)
+
+	// the built flag is set first so the key exists and is only trusted once renamed
+	if err := f.config.Connection.Do(radix.Pipeline(
+		radix.Cmd(nil, "SETBIT", buildKey, strconv.FormatUint(f.bits, 10), "1"),
+		radix.Cmd(nil, "PEXPIRE", buildKey, timeout),
+		radix.Cmd(nil, "SADD", buildsKey, buildKey),
+	)); err != nil {
+		return err
+	}
+
+	err := fill(func(keys []string) error {
+		commands := make([]radix.CmdAction, 0, len(keys)*f.hashes+1)
+		for _, key := range keys {
+			for _, position := range bloomPositions(key, f.bits, f.hashes) {
+				commands = append(commands, radix.Cmd(nil, "SETBIT", buildKey, strconv.FormatUint(position, 10), "1"))
+			}
+		}
+		commands = append(commands, radix.Cmd(nil, "PEXPIRE", buildKey, timeout))
+		return f.config.Connection.Do(radix.Pipeline(commands...))
+	})
+	if err != nil {
+		if cleanupErr := f.config.Connection.Do(radix.Pipeline(
+			radix.Cmd(nil, "SREM", buildsKey, buildKey),
+			radix.Cmd(nil, "DEL", buildKey),
+		)); cleanupErr != nil {
+			log.Err(cleanupErr).Send()
+		}
+		return err
+	}
+
+	var replaced int
+	if err := f.config.Connection.Do(radix.NewEvalScript(3, redisBloomReplaceScript).Cmd(&replaced, f.config.Key, buildsKey, buildKey)); err != nil {
+		return err
+	}
+	if replaced == 0 {
+		return ErrRedisBloomBuildExpired
+	}
+	return nil
+}
+
+// Create a new redis bloom filter, instances sharing a filter must use the same size
+func NewRedisBloomFilter(config RedisBloomConfig) *RedisBloomFilter {
+	config.BuildTimeout = fallback.Zero(config.BuildTimeout, time.Minute)
+	bits, hashes := config.parameters()
+	return &RedisBloomFilter{
+		config: config,
+		bits:   bits,
+		hashes: hashes,
+	}
+}
@@ -0,0 +1,544 @@
+package layer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+	"github.com/rs/zerolog/log"
+)
+
+// Extension of the segment files of the disk layer
+const DiskSegmentExtension = ".seg"
+
+// size of the record header, the payload length and the payload checksum
+const diskHeaderSize = 8
+
+// record flag for nil values, which codecs may not support
+const diskFlagNil = 1
+
+// Configuration for the disk data layer
+type DiskConfig struct {
+	// Directory holding the segment files, it is created if it does not exist
+	Dir string
+
+	// The duration of the cached data, set 0 to disable expiration
+	Retention time.Duration
+
+	// Maximum total size of the segment files in bytes, the oldest segments are evicted once it is exceeded, 0 = no limit
+	// Segments holding the records of the latest set are never evicted, so the size may exceed the limit by up to a
+	// segment, such as when the limit is smaller than SegmentSize
+	MaxSize int64
+
+	// Size in bytes after which a new segment file is started, defaults to 64MB
+	SegmentSize int64
+
+	// How often segments with mostly expired or overwritten records are compacted, defaults to 1 minute
+	CompactionInterval time.Duration
+
+	// Sync the segment file to the disk after every write, otherwise writes survive process crashes but may be lost
+	// if the machine crashes
+	Sync bool
+
+	// Codec used to encode the keys and values, defaults to lapis.GobCodec
+	Codec lapis.Codec
+}
+
+// Disk layer is a local on-disk cache for values that are expensive to load and should survive process restarts
+// Records are appended to segment files and located with an in-memory index, which is rebuilt from the segments
+// on startup. Expired and overwritten records are removed by compacting the segments.
+type Disk[TKey comparable, TValue any] struct {
+	config   DiskConfig
+	index    map[TKey]diskLocation
+	segments map[uint64]*diskSegment
+	active   *diskSegment // the segment new records are appended to
+	size     int64        // total size of the segment files
+	mu       sync.RWMutex
+	closed   chan struct{}
+	closing  sync.Once
+}
+
+// location of the latest record of a key
+type diskLocation struct {
+	segment  uint64
+	offset   int64
+	size     int64 // size of the record including its header
+	expireAt time.Time
+}
+
+// an append-only segment file
+type diskSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *Disk[TKey, TValue]) Identifier() string { return "disk" }
+
+// The function that will be used to resolve a set of keys
+func (l *Disk[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, k := range keys {
+		location, ok := l.index[k]
+		if !ok || (!location.expireAt.IsZero() && !location.expireAt.After(now)) {
+			errors[i] = lapis.NewErrNotFound(k)
+			continue
+		}
+		record := make([]byte, location.size)
+		if _, err := l.segments[location.segment].file.ReadAt(record, location.offset); err != nil {
+			errors[i] = err
+			continue
+		}
+		payload, err := verifyDiskRecord(record)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		if result[i], err = l.decodeValue(payload); err != nil {
+			errors[i] = err
+		}
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers
+func (l *Disk[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	var errors []error
+	var expireAt time.Time
+	if l.config.Retention > 0 {
+		expireAt = time.Now().Add(l.config.Retention)
+	}
+
+	// encode the records before taking the lock
+	records := make([][]byte, len(keys))
+	for i := range keys {
+		record, err := l.encodeRecord(keys[i], values[i], expireAt)
+		if err != nil {
+			if errors == nil {
+				errors = make([]error, len(keys))
+			}
+			errors[i] = err
+			continue
+		}
+		records[i] = record
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	written := l.active.id
+	for i, record := range records {
+		if record == nil {
+			continue
+		}
+		location, err := l.append(record)
+		if err != nil {
+			if errors == nil {
+				errors = make([]error, len(keys))
+			}
+			errors[i] = err
+			continue
+		}
+		location.expireAt = expireAt
+		l.index[keys[i]] = location
+	}
+	if l.config.Sync {
+		if err := l.active.file.Sync(); err != nil {
+			return fillArray(make([]error, len(keys)), err)
+		}
+	}
+	l.evict(written)
+	return errors
+}
+
+// Close the segment files and stop the compaction, closing the layer again does nothing
+func (l *Disk[TKey, TValue]) Close() error {
+	var err error
+	l.closing.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		close(l.closed)
+		for _, segment := range l.segments {
+			if closeErr := segment.file.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// append a record to the active segment, starting a new segment if the active segment is full
+// must be called while holding the lock
+func (l *Disk[TKey, TValue]) append(record []byte) (diskLocation, error) {
+	if l.active.size >= l.config.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return diskLocation{}, err
+		}
+	}
+	location := diskLocation{segment: l.active.id, offset: l.active.size, size: int64(len(record))}
+	if _, err := l.active.file.WriteAt(record, l.active.size); err != nil {
+		return diskLocation{}, err
+	}
+	l.active.size += int64(len(record))
+	l.size += int64(len(record))
+	return location, nil
+}
+
+// start a new active segment, must be called while holding the lock
+func (l *Disk[TKey, TValue]) rotate() error {
+	segment, err := l.openSegment(l.active.id + 1)
+	if err != nil {
+		return err
+	}
+	l.segments[segment.id] = segment
+	l.active = segment
+	return nil
+}
+
+// remove the oldest segments until the total size is within the limit, segments from the given id on hold the records
+// just written and are kept, must be called while holding the lock
+func (l *Disk[TKey, TValue]) evict(kept uint64) {
+	if l.config.MaxSize <= 0 {
+		return
+	}
+	for l.size > l.config.MaxSize {
+		oldest := l.oldestSegment()
+		if oldest.id >= kept {
+			return
+		}
+		for k, location := range l.index {
+			if location.segment == oldest.id {
+				delete(l.index, k)
+			}
+		}
+		l.removeSegment(oldest)
+	}
+}
+
+// get the segment with the lowest id, must be called while holding the lock
+func (l *Disk[TKey, TValue]) oldestSegment() *diskSegment {
+	oldest := l.active
+	for _, segment := range l.segments {
+		if segment.id < oldest.id {
+			oldest = segment
+		}
+	}
+	return oldest
+}
+
+// close and delete a segment file, must be called while holding the lock
+func (l *Disk[TKey, TValue]) removeSegment(segment *diskSegment) {
+	delete(l.segments, segment.id)
+	l.size -= segment.size
+	if err := segment.file.Close(); err != nil {
+		log.Err(err).Send()
+	}
+	if err := os.Remove(segment.file.Name()); err != nil {
+		log.Err(err).Send()
+	}
+}
+
+// periodically compact the segments until the layer is closed
+func (l *Disk[TKey, TValue]) startCompaction() {
+	go func() {
+		ticker := time.NewTicker(l.config.CompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.Compact()
+			case <-l.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Compact the segments, removing expired index entries and rewriting the live records of the segments that are
+// mostly made of expired or overwritten records into the active segment
+func (l *Disk[TKey, TValue]) Compact() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+		return
+	default:
+	}
+
+	// find the live size of each segment
+	now := time.Now()
+	live := make(map[uint64]int64, len(l.segments))
+	for k, location := range l.index {
+		if !location.expireAt.IsZero() && !location.expireAt.After(now) {
+			delete(l.index, k)
+			continue
+		}
+		live[location.segment] += location.size
+	}
+
+	ids := make([]uint64, 0, len(l.segments))
+	for id, segment := range l.segments {
+		if segment != l.active && live[id]*2 <= segment.size {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	written := l.active.id
+	for _, id := range ids {
+		if err := l.compactSegment(l.segments[id]); err != nil {
+			log.Err(err).Send()
+			break
+		}
+	}
+
+	// the rewritten records may exceed the size limit if a segment failed to be removed
+	l.evict(written)
+}
+
+// move the live records of a segment into the active segment and remove the segment, must be called while holding
+// the lock
+func (l *Disk[TKey, TValue]) compactSegment(segment *diskSegment) error {
+	for k, location := range l.index {
+		if location.segment != segment.id {
+			continue
+		}
+		record := make([]byte, location.size)
+		if _, err := segment.file.ReadAt(record, location.offset); err != nil {
+			return err
+		}
+		newLocation, err := l.append(record)
+		if err != nil {
+			return err
+		}
+		newLocation.expireAt = location.expireAt
+		l.index[k] = newLocation
+	}
+	if err := l.active.file.Sync(); err != nil {
+		return err
+	}
+	l.removeSegment(segment)
+	return nil
+}
+
+// encode a record: the header followed by the key length, key, expiration time, flags, and value
+func (l *Disk[TKey, TValue]) encodeRecord(key TKey, value TValue, expireAt time.Time) ([]byte, error) {
+	encodedKey, err := l.config.Codec.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	var flags byte
+	var encodedValue []byte
+	if isNil(value) {
+		flags |= diskFlagNil
+	} else if encodedValue, err = l.config.Codec.Marshal(value); err != nil {
+		return nil, err
+	}
+
+	var expireAtNano int64
+	if !expireAt.IsZero() {
+		expireAtNano = expireAt.UnixNano()
+	}
+	keyLength := make([]byte, binary.MaxVarintLen64)
+	keyLength = keyLength[:binary.PutUvarint(keyLength, uint64(len(encodedKey)))]
+	expiration := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiration, uint64(expireAtNano))
+
+	record := make([]byte, diskHeaderSize, diskHeaderSize+len(keyLength)+len(encodedKey)+9+len(encodedValue))
+	record = append(record, keyLength...)
+	record = append(record, encodedKey...)
+	record = append(record, expiration...)
+	record = append(record, flags)
+	record = append(record, encodedValue...)
+	payload := record[diskHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record, nil
+}
+
+// a decoded record payload
+type diskPayload struct {
+	key      []byte
+	expireAt time.Time
+	flags    byte
+	value    []byte
+}
+
+// check the checksum of a record and split its payload
+func verifyDiskRecord(record []byte) (diskPayload, error) {
+	if len(record) < diskHeaderSize {
+		return diskPayload{}, errDiskCorrupted
+	}
+	payload := record[diskHeaderSize:]
+	if int(binary.BigEndian.Uint32(record[0:4])) != len(payload) || binary.BigEndian.Uint32(record[4:8]) != crc32.ChecksumIEEE(payload) {
+		return diskPayload{}, errDiskCorrupted
+	}
+	keyLength, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < keyLength+9 {
+		return diskPayload{}, errDiskCorrupted
+	}
+	payload = payload[n:]
+	result := diskPayload{key: payload[:keyLength]}
+	payload = payload[keyLength:]
+	if expireAtNano := int64(binary.BigEndian.Uint64(payload)); expireAtNano != 0 {
+		result.expireAt = time.Unix(0, expireAtNano)
+	}
+	result.flags = payload[8]
+	result.value = payload[9:]
+	return result, nil
+}
+
+// decode the value of a record payload
+func (l *Disk[TKey, TValue]) decodeValue(payload diskPayload) (TValue, error) {
+	var value TValue
+	if payload.flags&diskFlagNil != 0 {
+		return value, nil
+	}
+	err := l.config.Codec.Unmarshal(payload.value, &value)
+	return value, err
+}
+
+// indicates that a record does not match its checksum, such as a record partially written during a crash
+var errDiskCorrupted = errors.New("disk layer: corrupted record")
+
+// open or create a segment file
+func (l *Disk[TKey, TValue]) openSegment(id uint64) (*diskSegment, error) {
+	path := filepath.Join(l.config.Dir, fmt.Sprintf("%016d%s", id, DiskSegmentExtension))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &diskSegment{id: id, file: file}, nil
+}
+
+// rebuild the index from the segment files, records after the first corrupted record of a segment are discarded
+// and the segment is truncated so new records are not appended after garbage
+func (l *Disk[TKey, TValue]) recover() error {
+	entries, err := os.ReadDir(l.config.Dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, DiskSegmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, DiskSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := time.Now()
+	for _, id := range ids {
+		segment, err := l.openSegment(id)
+		if err != nil {
+			return err
+		}
+		l.segments[id] = segment
+		if err := l.recoverSegment(segment, now); err != nil {
+			return err
+		}
+		l.size += segment.size
+		l.active = segment
+	}
+	if l.active == nil {
+		segment, err := l.openSegment(1)
+		if err != nil {
+			return err
+		}
+		l.segments[segment.id] = segment
+		l.active = segment
+	}
+	return nil
+}
+
+// read the records of a segment into the index, a record longer than the rest of the file is corrupted
+func (l *Disk[TKey, TValue]) recoverSegment(segment *diskSegment, now time.Time) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(segment.file, 0, info.Size()))
+	header := make([]byte, diskHeaderSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if offset+diskHeaderSize+length > info.Size() {
+			break
+		}
+		record := make([]byte, diskHeaderSize+length)
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[diskHeaderSize:]); err != nil {
+			break
+		}
+		payload, err := verifyDiskRecord(record)
+		if err != nil {
+			break
+		}
+		var key TKey
+		if err := l.config.Codec.Unmarshal(payload.key, &key); err != nil {
+			break
+		}
+		if payload.expireAt.IsZero() || payload.expireAt.After(now) {
+			l.index[key] = diskLocation{segment: segment.id, offset: offset, size: int64(len(record)), expireAt: payload.expireAt}
+		} else {
+			// an expired record still overrides the older records of the key
+			delete(l.index, key)
+		}
+		offset += int64(len(record))
+	}
+
+	if info.Size() != offset {
+		log.Warn().Msgf("disk layer: discarding %d bytes of corrupted records in %s", info.Size()-offset, segment.file.Name())
+		if err := segment.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	segment.size = offset
+	return nil
+}
+
+// Create a new disk data layer, the index is rebuilt from the segment files in the directory
+func NewDisk[TKey comparable, TValue any](config DiskConfig) (*Disk[TKey, TValue], error) {
+	if config.Codec == nil {
+		config.Codec = lapis.GobCodec{}
+	}
+	config.SegmentSize = fallback.Zero(config.SegmentSize, 64<<20)
+	config.CompactionInterval = fallback.Zero(config.CompactionInterval, time.Minute)
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &Disk[TKey, TValue]{
+		config:   config,
+		index:    make(map[TKey]diskLocation),
+		segments: make(map[uint64]*diskSegment),
+		closed:   make(chan struct{}),
+	}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	l.startCompaction()
+	return l, nil
+}
@@ -0,0 +1,163 @@
+package layer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+	"github.com/rs/zerolog/log"
+)
+
+// Configuration for the guard layer
+type GuardConfig[TKey comparable] struct {
+	// Filter of the keys that exist, see NewBloomFilter and NewRedisBloomFilter
+	Filter Filter
+
+	// Source of all existing keys used to build the filter, such as a database scan
+	// With a source, every key is let through until the filter is first built
+	// Without a source, the filter is trusted once it reports being built, such as a redis filter built by another
+	// instance, an in-memory filter without a source is never built so every key is let through, see ErrFilterNotBuilt
+	Source func() lapis.KeySource[TKey]
+
+	// Interval of rebuilding the filter from the source to drop deleted keys, 0 = the filter is only built once
+	RebuildInterval time.Duration
+
+	// Identifier of the layer, defaults to guard
+	Identifier string
+}
+
+// Indicates that the filter of a guard layer can't be rebuilt since the layer has no key source
+var ErrGuardNoSource = errors.New("guard layer: no key source")
+
+// Guard layer keeps a filter of the keys that exist and stops loads of keys that can't exist from reaching the next
+// layers, it is meant to be placed before the final layer
+// Keys that may exist are never resolved by the guard, they fall through to the next layer and are added to the
+// filter once loaded or set
+type Guard[TKey comparable, TValue any] struct {
+	config  GuardConfig[TKey]
+	ready   int32
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *Guard[TKey, TValue]) Identifier() string { return l.config.Identifier }
+
+// The function that will be used to resolve a set of keys, keys that can't exist have an authoritative
+// lapis.ErrNotFound and other keys fall through to the next layer
+// Keys also fall through if the filter is not built yet or fails
+func (l *Guard[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	var present []bool
+	if atomic.LoadInt32(&l.ready) == 1 {
+		var err error
+		if present, err = l.config.Filter.Test(stringifyKeys(keys, "")); err != nil {
+			if err != ErrFilterNotBuilt {
+				log.Err(err).Send()
+			}
+			present = nil
+		}
+	}
+	for i, k := range keys {
+		if present != nil && !present[i] {
+			errors[i] = lapis.NewErrAuthoritativeNotFound(k)
+		} else {
+			errors[i] = lapis.NewErrNotFound(k)
+		}
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, the keys are added to the filter
+func (l *Guard[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	if err := l.config.Filter.Add(stringifyKeys(keys, "")); err != nil {
+		return fillArray(make([]error, len(keys)), err)
+	}
+	return nil
+}
+
+// Rebuild the filter from the source, the guard trusts the filter once it is built
+func (l *Guard[TKey, TValue]) Rebuild(ctx context.Context) error {
+	if l.config.Source == nil {
+		return ErrGuardNoSource
+	}
+	err := l.config.Filter.Rebuild(func(add func(keys []string) error) error {
+		source := l.config.Source()
+		for {
+			keys, err := source.NextKeys(ctx)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return nil
+			}
+			if err := add(stringifyKeys(keys, "")); err != nil {
+				return err
+			}
+		}
+	})
+	if err == nil {
+		atomic.StoreInt32(&l.ready, 1)
+	}
+	return err
+}
+
+// build the filter and rebuild it periodically until the layer is closed
+func (l *Guard[TKey, TValue]) startRebuild() {
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-l.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if err := l.Rebuild(ctx); err != nil {
+			log.Err(err).Send()
+		}
+		if l.config.RebuildInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(l.config.RebuildInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Rebuild(ctx); err != nil {
+					log.Err(err).Send()
+				}
+			case <-l.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Stop rebuilding the filter
+func (l *Guard[TKey, TValue]) Close() error {
+	l.closing.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Create a new guard layer, the filter is built in the background when a source is configured
+func NewGuard[TKey comparable, TValue any](config GuardConfig[TKey]) *Guard[TKey, TValue] {
+	config.Identifier = fallback.Zero(config.Identifier, "guard")
+	l := &Guard[TKey, TValue]{
+		config: config,
+		closed: make(chan struct{}),
+	}
+	if config.Source == nil {
+		l.ready = 1
+	} else {
+		l.startRebuild()
+	}
+	return l
+}
@@ -0,0 +1,206 @@
+package layer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// Placeholder of the keys in the URL template of HTTPGet
+const HTTPKeysPlaceholder = "{keys}"
+
+// Configuration for the HTTP data layer
+type HTTPConfig[TKey comparable, TValue any] struct {
+	// Client used to send the requests, defaults to http.DefaultClient
+	Client *http.Client
+
+	// Build the request of a batch of keys, see HTTPGet and HTTPPostJSON
+	Request func(ctx context.Context, keys []TKey) (*http.Request, error)
+
+	// Decode the body of a successful response into values, defaults to decoding a JSON array
+	Decode func(body io.Reader) ([]TValue, error)
+
+	// Extract the key of a decoded value to match the values back to the keys
+	Key func(value TValue) TKey
+
+	// Timeout of each request, 0 = no timeout other than the client's
+	Timeout time.Duration
+
+	// Number of times a request failing with a transient status is retried, see ErrHTTPStatus.Transient
+	Retries int
+
+	// Duration to wait before retrying a request, defaults to 100 milliseconds
+	RetryWait time.Duration
+
+	// Identifier of the layer, defaults to http
+	Identifier string
+}
+
+// Maximum size of the body of an unsuccessful response that is read so the connection can be reused
+const httpDrainLimit = 64 << 10
+
+// Indicates that the HTTP layer is configured without a Request function
+var ErrHTTPNoRequest = errors.New("http layer: a Request function is required")
+
+// Indicates that the HTTP layer is configured without a Key function
+var ErrHTTPNoKey = errors.New("http layer: a Key function is required")
+
+// Indicates that the API responded with an unexpected status code
+type ErrHTTPStatus struct {
+	StatusCode int
+}
+
+func (e ErrHTTPStatus) Error() string {
+	return fmt.Sprintf("http layer: unexpected status %d", e.StatusCode)
+}
+
+// Check if the request may succeed when retried, such as for server errors and rate limits, transient statuses are
+// retried according to HTTPConfig.Retries
+func (e ErrHTTPStatus) Transient() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// HTTP layer loads values from an API supporting batch lookups with one request per batch, it is meant to be used
+// as the final layer
+type HTTP[TKey comparable, TValue any] struct {
+	config HTTPConfig[TKey, TValue]
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *HTTP[TKey, TValue]) Identifier() string { return l.config.Identifier }
+
+// The function that will be used to resolve a set of keys
+// Keys missing from the response or requested with a 404 response will have lapis.ErrNotFound
+func (l *HTTP[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+
+	decoded, err := l.fetch(keys)
+	for attempt := 0; attempt < l.config.Retries; attempt++ {
+		if statusErr, ok := err.(ErrHTTPStatus); !ok || !statusErr.Transient() {
+			break
+		}
+		time.Sleep(l.config.RetryWait)
+		decoded, err = l.fetch(keys)
+	}
+	if statusErr, ok := err.(ErrHTTPStatus); ok && statusErr.StatusCode == http.StatusNotFound {
+		for i, k := range keys {
+			errors[i] = lapis.NewErrNotFound(k)
+		}
+		return result, errors
+	}
+	if err != nil {
+		fillArray(errors, err)
+		return result, errors
+	}
+
+	values := make(map[TKey]TValue, len(decoded))
+	for _, value := range decoded {
+		values[l.config.Key(value)] = value
+	}
+	for i, k := range keys {
+		if value, ok := values[k]; ok {
+			result[i] = value
+		} else {
+			errors[i] = lapis.NewErrNotFound(k)
+		}
+	}
+	return result, errors
+}
+
+// send the request of a batch of keys and decode the values, unsuccessful statuses fail with ErrHTTPStatus
+func (l *HTTP[TKey, TValue]) fetch(keys []TKey) ([]TValue, error) {
+	ctx := context.Background()
+	if l.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.Timeout)
+		defer cancel()
+	}
+	request, err := l.config.Request(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	response, err := l.config.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		// read the body so the keep-alive connection can be reused
+		io.Copy(io.Discard, io.LimitReader(response.Body, httpDrainLimit))
+		return nil, ErrHTTPStatus{StatusCode: response.StatusCode}
+	}
+	return l.config.Decode(response.Body)
+}
+
+// The HTTP layer is the source of truth, so primed values are ignored
+func (l *HTTP[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	return nil
+}
+
+// HTTPGet builds GET requests from a URL template, the HTTPKeysPlaceholder in the template is replaced with the
+// comma-separated keys, e.g. https://api.example.com/users?ids={keys}
+func HTTPGet[TKey comparable](urlTemplate string) func(ctx context.Context, keys []TKey) (*http.Request, error) {
+	return func(ctx context.Context, keys []TKey) (*http.Request, error) {
+		formatted := make([]string, len(keys))
+		for i, k := range keys {
+			formatted[i] = url.QueryEscape(fmt.Sprint(k))
+		}
+		return http.NewRequestWithContext(ctx, http.MethodGet, strings.Replace(urlTemplate, HTTPKeysPlaceholder, strings.Join(formatted, ","), 1), nil)
+	}
+}
+
+// HTTPPostJSON builds POST requests to the given URL with the keys as a JSON array body
+func HTTPPostJSON[TKey comparable](url string) func(ctx context.Context, keys []TKey) (*http.Request, error) {
+	return func(ctx context.Context, keys []TKey) (*http.Request, error) {
+		body, err := json.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return request, nil
+	}
+}
+
+// decode a JSON array of values
+func decodeJSONArray[TValue any](body io.Reader) ([]TValue, error) {
+	var values []TValue
+	err := json.NewDecoder(body).Decode(&values)
+	return values, err
+}
+
+// Create a new HTTP data layer
+func NewHTTP[TKey comparable, TValue any](config HTTPConfig[TKey, TValue]) (*HTTP[TKey, TValue], error) {
+	if config.Request == nil {
+		return nil, ErrHTTPNoRequest
+	}
+	if config.Key == nil {
+		return nil, ErrHTTPNoKey
+	}
+	config.Identifier = fallback.Zero(config.Identifier, "http")
+	config.RetryWait = fallback.Zero(config.RetryWait, 100*time.Millisecond)
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Decode == nil {
+		config.Decode = decodeJSONArray[TValue]
+	}
+	return &HTTP[TKey, TValue]{
+		config: config,
+	}, nil
+}
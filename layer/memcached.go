@@ -0,0 +1,309 @@
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// memcached treats expiration times longer than 30 days as unix timestamps
+const memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+// the maximum length of a memcached key
+const memcachedMaxKeyLength = 250
+
+// Configuration for the memcached data layer
+type MemcachedConfig struct {
+	// The duration of the cached data, set 0 to disable expiration
+	Retention time.Duration
+
+	// Address of the memcached server
+	Address string
+
+	// Key prefix to be used in memcached keys
+	KeyPrefix string
+
+	// Maximum number of idle connections kept open, defaults to 8
+	MaxIdleConnections int
+
+	// Timeout of each request, defaults to 1 second
+	Timeout time.Duration
+
+	// Codec used to encode the values, defaults to lapis.GobCodec
+	Codec lapis.Codec
+}
+
+// Memcached layer is memcached-backed cache layer speaking the text protocol with configurable expiration time
+type Memcached[TKey comparable, TValue any] struct {
+	config MemcachedConfig
+	idle   chan *memcachedConn
+}
+
+// a connection to the memcached server
+type memcachedConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// Indicates that memcached responded with an error or an unexpected response
+type ErrMemcached struct {
+	Response string
+}
+
+func (e ErrMemcached) Error() string {
+	return fmt.Sprintf("memcached layer: unexpected response %q", e.Response)
+}
+
+// Indicates that a key can't be used as a memcached key since it is too long or contains whitespace
+var ErrMemcachedInvalidKey = errors.New("memcached layer: invalid key")
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *Memcached[TKey, TValue]) Identifier() string { return "memcached" }
+
+// The function that will be used to resolve a set of keys
+func (l *Memcached[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	keysString := l.stringifyKeys(keys, errors)
+
+	// request the valid keys with a single get command
+	command := bytes.Buffer{}
+	command.WriteString("get")
+	requested := 0
+	for i, key := range keysString {
+		if errors[i] == nil {
+			command.WriteString(" ")
+			command.WriteString(key)
+			requested++
+		}
+	}
+	command.WriteString("\r\n")
+	if requested == 0 {
+		return result, errors
+	}
+
+	values := make(map[string][]byte, requested)
+	err := l.do(func(c *memcachedConn) error {
+		if _, err := c.writer.Write(command.Bytes()); err != nil {
+			return err
+		}
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+		for {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			if err := memcachedError(line); err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return ErrMemcached{Response: line}
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return ErrMemcached{Response: line}
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(c.reader, data); err != nil {
+				return err
+			}
+			values[fields[1]] = data[:size]
+		}
+	})
+
+	for i, k := range keys {
+		if errors[i] != nil {
+			continue
+		}
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		data, ok := values[keysString[i]]
+		if !ok {
+			errors[i] = lapis.NewErrNotFound(k)
+			continue
+		}
+		if err := decodeValue(l.config.Codec, data, &result[i]); err != nil {
+			errors[i] = err
+		}
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, the set commands are pipelined
+// Keys rejected by the server, such as values too large for the cache, fail on their own while the other keys are
+// still stored
+func (l *Memcached[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	errors := make([]error, len(keys))
+	keysString := l.stringifyKeys(keys, errors)
+	expiration := l.expiration()
+
+	command := bytes.Buffer{}
+	var sentIndexes []int
+	for i, value := range values {
+		if errors[i] != nil {
+			continue
+		}
+		encoded, err := encodeValue(l.config.Codec, value)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		fmt.Fprintf(&command, "set %s 0 %d %d\r\n", keysString[i], expiration, len(encoded))
+		command.Write(encoded)
+		command.WriteString("\r\n")
+		sentIndexes = append(sentIndexes, i)
+	}
+	if len(sentIndexes) == 0 {
+		return errors
+	}
+
+	read := 0
+	err := l.do(func(c *memcachedConn) error {
+		if _, err := c.writer.Write(command.Bytes()); err != nil {
+			return err
+		}
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+		for _, i := range sentIndexes {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			read++
+			switch {
+			case line == "STORED":
+			case line == "NOT_STORED" || strings.HasPrefix(line, "SERVER_ERROR"):
+				errors[i] = ErrMemcached{Response: line}
+			default:
+				// other responses mean that the replies are out of sync with the commands, so the remaining replies
+				// can't be trusted and the connection is discarded
+				errors[i] = ErrMemcached{Response: line}
+				return errors[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, i := range sentIndexes[read:] {
+			errors[i] = err
+		}
+	}
+	return errors
+}
+
+// get the expiration time of the set commands
+func (l *Memcached[TKey, TValue]) expiration() int64 {
+	if l.config.Retention <= 0 {
+		return 0
+	}
+	if l.config.Retention > memcachedMaxRelativeExpiration {
+		return time.Now().Add(l.config.Retention).Unix()
+	}
+	seconds := int64(l.config.Retention / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// convert the keys to memcached keys, invalid keys will have ErrMemcachedInvalidKey in the errors array
+func (l *Memcached[TKey, TValue]) stringifyKeys(keys []TKey, errors []error) []string {
+	keysString := stringifyKeys(keys, l.config.KeyPrefix)
+	for i, key := range keysString {
+		if len(key) == 0 || len(key) > memcachedMaxKeyLength || strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+			errors[i] = ErrMemcachedInvalidKey
+		}
+	}
+	return keysString
+}
+
+// run a request on an idle connection or a new connection, connections are discarded if the request fails
+func (l *Memcached[TKey, TValue]) do(request func(c *memcachedConn) error) error {
+	var c *memcachedConn
+	select {
+	case c = <-l.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", l.config.Address, l.config.Timeout)
+		if err != nil {
+			return err
+		}
+		c = &memcachedConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(l.config.Timeout)); err != nil {
+		c.conn.Close()
+		return err
+	}
+	if err := request(c); err != nil {
+		c.conn.Close()
+		return err
+	}
+
+	select {
+	case l.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return nil
+}
+
+// read a line of the response without its line ending
+func (c *memcachedConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// get the error of an error response line, nil for other lines
+func memcachedError(line string) error {
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return ErrMemcached{Response: line}
+	}
+	return nil
+}
+
+// Close the idle connections
+func (l *Memcached[TKey, TValue]) Close() error {
+	for {
+		select {
+		case c := <-l.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Create a new memcached data layer
+func NewMemcached[TKey comparable, TValue any](config MemcachedConfig) *Memcached[TKey, TValue] {
+	if config.Codec == nil {
+		config.Codec = lapis.GobCodec{}
+	}
+	config.Timeout = fallback.Zero(config.Timeout, time.Second)
+	return &Memcached[TKey, TValue]{
+		config: config,
+		idle:   make(chan *memcachedConn, fallback.Zero(config.MaxIdleConnections, 8)),
+	}
+}
@@ -1,6 +1,10 @@
 package layer
 
 import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,15 +17,46 @@ import (
 type MemoryConfig struct {
 	// The duration of the cached data
 	Retention time.Duration
+
+	// The duration of leases issued on misses, set 0 to disable leases
+	LeaseTTL time.Duration
+
+	// Codec used to encode the values in snapshots, defaults to lapis.GobCodec
+	Codec lapis.Codec
 }
 
 // Memory layer is map-based in-memory cache, it should be used as the first line of cache
 // with short data expiration
 type Memory[TKey comparable, TValue any] struct {
 	config            MemoryConfig
-	data              map[TKey]TValue
+	data              map[TKey]memoryEntry[TValue]
 	mu                sync.RWMutex
 	invalidationQueue *queue.Queue[tuple.Pair[time.Time, TKey]]
+	leases            map[TKey]memoryLease
+	leaseCounter      uint64
+	leaseSweepSize    int                          // number of leases that triggers the next sweep of expired leases
+	tags              map[string]map[TKey]struct{} // keys stored with each tag
+}
+
+// a lease issued for a missing key
+type memoryLease struct {
+	token    lapis.Lease
+	expireAt time.Time
+}
+
+// a cached value with the time it was stored
+type memoryEntry[TValue any] struct {
+	value    TValue
+	version  int64
+	setAt    time.Time
+	expireAt time.Time // zero if the entry does not expire
+	tags     []string
+}
+
+// check if an entry has not expired, expired entries are held until the invalidator reaches them, which may be late
+// for restored entries scheduled behind later expirations
+func (e memoryEntry[TValue]) live(now time.Time) bool {
+	return e.expireAt.IsZero() || e.expireAt.After(now)
 }
 
 // Unique identifier for this layer used for logging and metric purposes
@@ -29,36 +64,300 @@ func (l *Memory[TKey, TValue]) Identifier() string { return "memory" }
 
 // The function that will be used to resolve a set of keys
 func (l *Memory[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result, _, errors := l.GetWithTime(keys)
+	return result, errors
+}
+
+// Resolve a set of keys along with the time each value was stored
+func (l *Memory[TKey, TValue]) GetWithTime(keys []TKey) ([]TValue, []time.Time, []error) {
 	result := make([]TValue, len(keys))
+	times := make([]time.Time, len(keys))
 	errors := make([]error, len(keys))
+	now := time.Now()
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	for i, k := range keys {
-		if v, ok := l.data[k]; ok {
-			result[i] = v
+		if e, ok := l.data[k]; ok && e.live(now) {
+			result[i] = e.value
+			times[i] = e.setAt
 		} else {
 			errors[i] = lapis.NewErrNotFound(k)
 		}
 	}
-	return result, errors
+	return result, times, errors
+}
+
+// Resolve a set of keys, issuing leases for missing keys if leases are enabled
+// Missing keys that already have an active lease will have lapis.ErrHotMiss
+func (l *Memory[TKey, TValue]) GetLeased(keys []TKey) ([]TValue, []lapis.Lease, []error) {
+	if l.config.LeaseTTL <= 0 {
+		result, errors := l.Get(keys)
+		return result, nil, errors
+	}
+	result := make([]TValue, len(keys))
+	leases := make([]lapis.Lease, len(keys))
+	errors := make([]error, len(keys))
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, k := range keys {
+		if e, ok := l.data[k]; ok && e.live(now) {
+			result[i] = e.value
+			continue
+		}
+		if lease, ok := l.leases[k]; ok && lease.expireAt.After(now) {
+			errors[i] = lapis.ErrHotMiss
+			continue
+		}
+		l.leaseCounter++
+		leases[i] = lapis.Lease(l.leaseCounter)
+		l.leases[k] = memoryLease{token: leases[i], expireAt: now.Add(l.config.LeaseTTL)}
+		errors[i] = lapis.NewErrNotFound(k)
+	}
+	l.sweepLeases(now)
+	return result, leases, errors
+}
+
+// remove expired leases when the number of leases has doubled since the last sweep, must be called while holding the lock
+func (l *Memory[TKey, TValue]) sweepLeases(now time.Time) {
+	if len(l.leases) < l.leaseSweepSize {
+		return
+	}
+	for k, lease := range l.leases {
+		if !lease.expireAt.After(now) {
+			delete(l.leases, k)
+		}
+	}
+	l.leaseSweepSize = 2 * len(l.leases)
+	if l.leaseSweepSize < 1024 {
+		l.leaseSweepSize = 1024
+	}
+}
+
+// Get the keys of every value held by the layer, such as to warm another instance with lapis.WriteKeySnapshot
+func (l *Memory[TKey, TValue]) Keys() []TKey {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	keys := make([]TKey, 0, len(l.data))
+	for k, e := range l.data {
+		if e.live(now) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
 }
 
 // The function that will be called for successful resolvers
 func (l *Memory[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	now := time.Now()
 	l.mu.Lock()
 	for i, k := range keys {
-		l.data[k] = values[i]
-		l.invalidationQueue.Enqueue(tuple.NewPair(time.Now().Add(l.config.Retention), k))
+		l.store(k, values[i], 0, nil, now)
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Set values along with their metadata
+// Versioned values are only stored if they are newer than the stored value and
+// leased values are only stored if their lease has not expired or been revoked by another write
+func (l *Memory[TKey, TValue]) SetEntries(keys []TKey, entries []lapis.Entry[TValue]) []error {
+	errors := make([]error, len(keys))
+	now := time.Now()
+	l.mu.Lock()
+	for i, k := range keys {
+		if entries[i].Lease != 0 {
+			if lease, ok := l.leases[k]; !ok || lease.token != entries[i].Lease || !lease.expireAt.After(now) {
+				errors[i] = lapis.ErrInvalidLease
+				continue
+			}
+		}
+		if existing, ok := l.data[k]; ok && existing.live(now) && entries[i].Version != 0 && existing.version >= entries[i].Version {
+			errors[i] = lapis.ErrStaleVersion
+			continue
+		}
+		l.store(k, entries[i].Value, entries[i].Version, entries[i].Tags, now)
+	}
+	l.mu.Unlock()
+	return errors
+}
+
+// store a value, revoke the lease of the key, and schedule its expiration, must be called while holding the lock
+func (l *Memory[TKey, TValue]) store(key TKey, value TValue, version int64, tags []string, now time.Time) {
+	e := memoryEntry[TValue]{value: value, version: version, setAt: now, tags: tags}
+	if l.invalidationQueue != nil {
+		e.expireAt = now.Add(l.config.Retention)
+	}
+	l.put(key, e)
+}
+
+// store an entry, revoke the lease of the key, and schedule its expiration, must be called while holding the lock
+func (l *Memory[TKey, TValue]) put(key TKey, e memoryEntry[TValue]) {
+	delete(l.leases, key)
+	if existing, ok := l.data[key]; ok {
+		l.untag(key, existing.tags)
+	}
+	if l.invalidationQueue != nil && !e.expireAt.IsZero() {
+		l.invalidationQueue.Enqueue(tuple.NewPair(e.expireAt, key))
+	}
+	for _, tag := range e.tags {
+		if l.tags[tag] == nil {
+			l.tags[tag] = make(map[TKey]struct{})
+		}
+		l.tags[tag][key] = struct{}{}
+	}
+	l.data[key] = e
+}
+
+// remove a stored value and revoke the lease of the key, must be called while holding the lock
+func (l *Memory[TKey, TValue]) remove(key TKey) {
+	delete(l.leases, key)
+	if e, ok := l.data[key]; ok {
+		l.untag(key, e.tags)
+		delete(l.data, key)
+	}
+}
+
+// remove a key from the tag index, must be called while holding the lock
+func (l *Memory[TKey, TValue]) untag(key TKey, tags []string) {
+	for _, tag := range tags {
+		delete(l.tags[tag], key)
+		if len(l.tags[tag]) == 0 {
+			delete(l.tags, tag)
+		}
+	}
+}
+
+// Evict every value stored with any of the given tags
+func (l *Memory[TKey, TValue]) InvalidateTags(tags []string) error {
+	l.mu.Lock()
+	for _, tag := range tags {
+		for key := range l.tags[tag] {
+			l.remove(key)
+		}
 	}
 	l.mu.Unlock()
 	return nil
 }
 
+// an entry as written in a snapshot
+type memorySnapshotEntry[TKey comparable] struct {
+	Key      TKey
+	Value    []byte
+	Nil      bool // the value is a nil pointer or interface, which codecs may not support
+	Version  int64
+	SetAt    time.Time
+	ExpireAt time.Time
+	Tags     []string
+}
+
+// Write the live entries along with their expiration time to the given writer, such as a local file,
+// to be restored with Restore after the process restarts
+func (l *Memory[TKey, TValue]) Export(w io.Writer) error {
+	now := time.Now()
+	l.mu.RLock()
+	keys := make([]TKey, 0, len(l.data))
+	entries := make([]memoryEntry[TValue], 0, len(l.data))
+	for k, e := range l.data {
+		if e.live(now) {
+			keys = append(keys, k)
+			entries = append(entries, e)
+		}
+	}
+	l.mu.RUnlock()
+
+	encoder := gob.NewEncoder(w)
+	for i, e := range entries {
+		snapshotEntry := memorySnapshotEntry[TKey]{
+			Key:      keys[i],
+			Nil:      isNil(e.value),
+			Version:  e.version,
+			SetAt:    e.setAt,
+			ExpireAt: e.expireAt,
+			Tags:     e.tags,
+		}
+		if !snapshotEntry.Nil {
+			value, err := l.config.Codec.Marshal(e.value)
+			if err != nil {
+				return err
+			}
+			snapshotEntry.Value = value
+		}
+		if err := encoder.Encode(snapshotEntry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore the entries written by Export, entries that have expired since they were exported are skipped and
+// keys that are already held by the layer are kept since they are newer than the snapshot
+func (l *Memory[TKey, TValue]) Restore(r io.Reader) error {
+	decoder := gob.NewDecoder(r)
+	var snapshotEntries []memorySnapshotEntry[TKey]
+	var values []TValue
+	for {
+		var snapshotEntry memorySnapshotEntry[TKey]
+		if err := decoder.Decode(&snapshotEntry); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		var value TValue
+		if !snapshotEntry.Nil {
+			if err := l.config.Codec.Unmarshal(snapshotEntry.Value, &value); err != nil {
+				return err
+			}
+		}
+		snapshotEntries = append(snapshotEntries, snapshotEntry)
+		values = append(values, value)
+	}
+
+	// schedule the expirations in order
+	indexes := make([]int, len(snapshotEntries))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(a, b int) bool {
+		return snapshotEntries[indexes[a]].ExpireAt.Before(snapshotEntries[indexes[b]].ExpireAt)
+	})
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, i := range indexes {
+		snapshotEntry := snapshotEntries[i]
+		if existing, ok := l.data[snapshotEntry.Key]; ok && existing.live(now) {
+			continue
+		}
+		e := memoryEntry[TValue]{value: values[i], version: snapshotEntry.Version, setAt: snapshotEntry.SetAt, tags: snapshotEntry.Tags}
+		if l.invalidationQueue != nil {
+			e.expireAt = snapshotEntry.ExpireAt
+			if e.expireAt.IsZero() {
+				e.expireAt = now.Add(l.config.Retention)
+			}
+			if !e.expireAt.After(now) {
+				continue
+			}
+		}
+		l.put(snapshotEntry.Key, e)
+	}
+	return nil
+}
+
 // Create a new in-memory data layer
 func NewMemory[TKey comparable, TValue any](config MemoryConfig) *Memory[TKey, TValue] {
+	if config.Codec == nil {
+		config.Codec = lapis.GobCodec{}
+	}
 	l := &Memory[TKey, TValue]{
-		config: config,
-		data:   make(map[TKey]TValue),
+		config:         config,
+		data:           make(map[TKey]memoryEntry[TValue]),
+		leases:         make(map[TKey]memoryLease),
+		leaseSweepSize: 1024,
+		tags:           make(map[string]map[TKey]struct{}),
 	}
 	if config.Retention > 0 {
 		l.startInvalidator()
@@ -78,8 +377,12 @@ func (l *Memory[TKey, TValue]) startInvalidator() {
 				if time.Now().Before(nextJob.V1) {
 					time.Sleep(time.Until(nextJob.V1))
 				}
+				// the entry may have been set again after this job was scheduled
 				l.mu.Lock()
-				delete(l.data, nextJob.V2)
+				if e, ok := l.data[nextJob.V2]; ok && !e.expireAt.After(nextJob.V1) {
+					l.untag(nextJob.V2, e.tags)
+					delete(l.data, nextJob.V2)
+				}
 				l.mu.Unlock()
 			}
 		}
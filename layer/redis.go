@@ -1,11 +1,13 @@
 package layer
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/flowscan/lapis"
@@ -13,9 +15,121 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// A hard-coded constant for nil values to differentiate nil and undefined (not found) values
+// A hard-coded constant for nil values to differentiate nil and undefined (not found) values, it is shared by the
+// layers storing encoded values such as memcached
 const RedisNilValue = "__@@@__LAPIS_REDIS_NIL_VALUE"
 
+// Suffix of the redis keys holding the version of versioned values
+const RedisVersionSuffix = ":__lapis_version"
+
+// Suffix of the redis keys holding the lease issued for missing values
+const RedisLeaseSuffix = ":__lapis_lease"
+
+// Prefix of the redis sets holding the keys stored with each tag, placed after the key prefix
+const RedisTagPrefix = "__lapis_tag:"
+
+// Sets values whose version is newer than the stored version and whose lease is still held, versions are compared
+// as signed decimal strings since lua numbers can't represent every int64, successful writes revoke the lease of the key
+// and add the key to the sets of its tags, which expire along with their newest member
+// KEYS: triples of value key, version key, and lease key
+// ARGV: retention in milliseconds, followed by the value, version (0 = unversioned), lease (0 = unleased),
+// number of tags, and tag set keys of each entry
+// Results: 1 = stored, 0 = stale version, 2 = invalid lease
+var redisSetEntriesScript = `
+local function newer(a, b)
+	local aNegative, bNegative = a:sub(1, 1) == '-', b:sub(1, 1) == '-'
+	if aNegative ~= bNegative then
+		return bNegative
+	end
+	if aNegative then
+		return newer(b:sub(2), a:sub(2))
+	end
+	if #a ~= #b then
+		return #a > #b
+	end
+	return a > b
+end
+local retention = tonumber(ARGV[1])
+local results = {}
+local cursor = 2
+for i = 1, #KEYS / 3 do
+	local key = KEYS[3 * i - 2]
+	local versionKey = KEYS[3 * i - 1]
+	local leaseKey = KEYS[3 * i]
+	local value = ARGV[cursor]
+	local version = ARGV[cursor + 1]
+	local lease = ARGV[cursor + 2]
+	local tagCount = tonumber(ARGV[cursor + 3])
+	local tagStart = cursor + 4
+	cursor = tagStart + tagCount
+	local current = redis.call('GET', versionKey)
+	if lease ~= '0' and redis.call('GET', leaseKey) ~= lease then
+		results[i] = 2
+	elseif version == '0' or not current or newer(version, current) then
+		if retention > 0 then
+			redis.call('SET', key, value, 'PX', retention)
+		else
+			redis.call('SET', key, value)
+		end
+		if version ~= '0' then
+			if retention > 0 then
+				redis.call('SET', versionKey, version, 'PX', retention)
+			else
+				redis.call('SET', versionKey, version)
+			end
+		end
+		redis.call('DEL', leaseKey)
+		for j = tagStart, tagStart + tagCount - 1 do
+			redis.call('SADD', ARGV[j], key)
+			if retention > 0 then
+				redis.call('PEXPIRE', ARGV[j], retention)
+			end
+		end
+		results[i] = 1
+	else
+		results[i] = 0
+	end
+end
+return results
+`
+
+// Gets values and issues leases for the missing ones, a lease is only issued if no other lease is held for the key
+// KEYS: pairs of value key and lease key
+// ARGV: lease duration in milliseconds, followed by the lease token for each key
+// Results: pairs of value and status, the status is empty for hits, the issued token, or - if the key is hot
+var redisGetLeasedScript = `
+local ttl = ARGV[1]
+local results = {}
+for i = 1, #KEYS / 2 do
+	local value = redis.call('GET', KEYS[2 * i - 1])
+	if value then
+		results[2 * i - 1] = value
+		results[2 * i] = ''
+	elseif redis.call('SET', KEYS[2 * i], ARGV[i + 1], 'NX', 'PX', ttl) then
+		results[2 * i - 1] = ''
+		results[2 * i] = ARGV[i + 1]
+	else
+		results[2 * i - 1] = ''
+		results[2 * i] = '-'
+	end
+end
+return results
+`
+
+// Deletes every key in the given tag sets along with their version and lease keys, then deletes the tag sets
+// The deleted keys are not declared in KEYS, so the script only works on a single redis node and not on a cluster
+// KEYS: tag set keys
+// ARGV: version key suffix and lease key suffix
+var redisInvalidateTagsScript = `
+for _, tagKey in ipairs(KEYS) do
+	for _, key in ipairs(redis.call('SMEMBERS', tagKey)) do
+		redis.call('DEL', key, key .. ARGV[1], key .. ARGV[2])
+	end
+	redis.call('DEL', tagKey)
+end
+return 0
+`
+
 // Configuration for the redis data layer
 type RedisConfig struct {
 	// The duration of the cached data, set 0 to disable expiration
@@ -26,9 +140,15 @@ type RedisConfig struct {
 
 	// Key prefix to be used in redis keys
 	KeyPrefix string
+
+	// The duration of leases issued on misses, set 0 to disable leases
+	LeaseTTL time.Duration
+
+	// Codec used to encode the values, defaults to lapis.GobCodec
+	Codec lapis.Codec
 }
 
-// RedisGob layer is redis-backed cache layer with gob encoding and configurable expiration time
+// RedisGob layer is redis-backed cache layer with gob encoding by default and configurable expiration time
 type RedisGob[TKey comparable, TValue any] struct {
 	config RedisConfig
 }
@@ -45,24 +165,116 @@ func (l *RedisGob[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
 	if err := l.config.Connection.Do(radix.Cmd(&cacheBuffer, "MGET", stringifyKeys(keys, l.config.KeyPrefix)...)); err != nil {
 		fillArray(errors, err)
 	} else {
-		for i, k := range keys {
-			if cacheBuffer[i] != nil {
-				// handle nil values since it is defined with a constant
-				if string(cacheBuffer[i]) == RedisNilValue {
-					var zeroValue TValue
-					result[i] = zeroValue
-				}
-				buffer := bytes.NewBuffer(cacheBuffer[i])
-				if err := gob.NewDecoder(buffer).Decode(&result[i]); err != nil {
-					errors[i] = err
-				}
-			} else {
-				errors[i] = lapis.NewErrNotFound(k)
+		l.decode(keys, cacheBuffer, result, errors)
+	}
+
+	return result, errors
+}
+
+// Resolve a set of keys along with the time each value was stored, the time is derived from the remaining time
+// to live of the keys, so values stored without retention are reported as stored at the zero time
+func (l *RedisGob[TKey, TValue]) GetWithTime(keys []TKey) ([]TValue, []time.Time, []error) {
+	keysCount := len(keys)
+	result := make([]TValue, keysCount)
+	times := make([]time.Time, keysCount)
+	errors := make([]error, keysCount)
+	cacheBuffer := make([][]byte, keysCount)
+	ttls := make([]int64, keysCount)
+	keysString := stringifyKeys(keys, l.config.KeyPrefix)
+	commands := make([]radix.CmdAction, 1+keysCount)
+	commands[0] = radix.Cmd(&cacheBuffer, "MGET", keysString...)
+	for i, key := range keysString {
+		commands[i+1] = radix.Cmd(&ttls[i], "PTTL", key)
+	}
+	if err := l.config.Connection.Do(radix.Pipeline(commands...)); err != nil {
+		fillArray(errors, err)
+	} else {
+		l.decode(keys, cacheBuffer, result, errors)
+		now := time.Now()
+		for i := range keys {
+			if l.config.Retention > 0 && ttls[i] >= 0 {
+				times[i] = now.Add(time.Duration(ttls[i])*time.Millisecond - l.config.Retention)
 			}
 		}
 	}
 
-	return result, errors
+	return result, times, errors
+}
+
+// Resolve a set of keys, issuing leases for missing keys if leases are enabled
+// Missing keys that already have an active lease will have lapis.ErrHotMiss
+func (l *RedisGob[TKey, TValue]) GetLeased(keys []TKey) ([]TValue, []lapis.Lease, []error) {
+	if l.config.LeaseTTL <= 0 {
+		result, errors := l.Get(keys)
+		return result, nil, errors
+	}
+	keysCount := len(keys)
+	result := make([]TValue, keysCount)
+	leases := make([]lapis.Lease, keysCount)
+	errors := make([]error, keysCount)
+	keysString := stringifyKeys(keys, l.config.KeyPrefix)
+	scriptKeys := make([]string, 0, 2*keysCount)
+	scriptArguments := []string{strconv.FormatInt(l.config.LeaseTTL.Milliseconds(), 10)}
+	for i, key := range keysString {
+		token, err := newRedisLease()
+		if err != nil {
+			fillArray(errors, err)
+			return result, nil, errors
+		}
+		scriptKeys = append(scriptKeys, key, key+RedisLeaseSuffix)
+		scriptArguments = append(scriptArguments, strconv.FormatUint(uint64(token), 10))
+		leases[i] = token
+	}
+
+	response := make([][]byte, 0, 2*keysCount)
+	script := radix.NewEvalScript(len(scriptKeys), redisGetLeasedScript)
+	if err := l.config.Connection.Do(script.Cmd(&response, append(scriptKeys, scriptArguments...)...)); err != nil {
+		fillArray(errors, err)
+		return result, nil, errors
+	}
+	cacheBuffer := make([][]byte, keysCount)
+	for i := range keys {
+		switch status := string(response[2*i+1]); status {
+		case "":
+			cacheBuffer[i] = response[2*i]
+			leases[i] = 0
+		case "-":
+			leases[i] = 0
+		}
+	}
+	l.decode(keys, cacheBuffer, result, errors)
+	for i := range keys {
+		if cacheBuffer[i] == nil && leases[i] == 0 {
+			errors[i] = lapis.ErrHotMiss
+		}
+	}
+	return result, leases, errors
+}
+
+// generate a random non-zero lease token
+func newRedisLease() (lapis.Lease, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		if token := lapis.Lease(binary.BigEndian.Uint64(b)); token != 0 {
+			return token, nil
+		}
+	}
+}
+
+// decode the raw redis values into the result array
+func (l *RedisGob[TKey, TValue]) decode(keys []TKey, cacheBuffer [][]byte, result []TValue, errors []error) {
+	for i, k := range keys {
+		if cacheBuffer[i] != nil {
+			if err := decodeValue(l.config.Codec, cacheBuffer[i], &result[i]); err != nil {
+				errors[i] = err
+			}
+		} else {
+			errors[i] = lapis.NewErrNotFound(k)
+		}
+	}
 }
 
 // The function that will be called for successful resolvers
@@ -70,34 +282,30 @@ func (l *RedisGob[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
 	count := len(keys)
 
 	// prepare batch SET commands using MSET
-	cacheArguments := make([]string, 2*count)
+	cacheArguments := make([]string, 0, 2*count)
 	keysString := stringifyKeys(keys, l.config.KeyPrefix)
 	for i, value := range values {
-		// handle nil values
-		// gob does not support nil pointers unfortunately
-		if reflect.TypeOf(value).Kind() == reflect.Pointer && reflect.ValueOf(value).IsNil() {
-			// we set the hard-coded nil constant for nil values
-			cacheArguments[2*i+1] = RedisNilValue
-		} else {
-			b := bytes.Buffer{}
-			err := gob.NewEncoder(&b).Encode(value)
-			if err != nil {
-				log.Err(err).Send()
-				continue
-			}
-			cacheArguments[2*i+1] = b.String()
+		encoded, err := l.encode(value)
+		if err != nil {
+			log.Err(err).Send()
+			continue
 		}
-		cacheArguments[2*i] = keysString[i]
+		cacheArguments = append(cacheArguments, keysString[i], encoded)
 	}
-	commands := make([]radix.CmdAction, 1+count)
-	commands[0] = radix.Cmd(nil, "MSET", cacheArguments...)
+	commands := make([]radix.CmdAction, 0, 2+count)
+	commands = append(commands, radix.Cmd(nil, "MSET", cacheArguments...))
 
 	// prepare EXPIRE commands
 	if l.config.Retention > 0 {
-		for i, key := range keysString {
-			commands[i+1] = radix.Cmd(nil, "EXPIRE", key, strconv.FormatInt(int64(l.config.Retention.Seconds()), 10))
+		for _, key := range keysString {
+			commands = append(commands, radix.Cmd(nil, "EXPIRE", key, strconv.FormatInt(int64(l.config.Retention.Seconds()), 10)))
 		}
 	}
+
+	// revoke the leases of the written keys
+	if l.config.LeaseTTL > 0 {
+		commands = append(commands, radix.Cmd(nil, "DEL", mapFn(keysString, func(key string) string { return key + RedisLeaseSuffix })...))
+	}
 	err := l.config.Connection.Do(radix.Pipeline(commands...))
 	if err != nil {
 		log.Err(err).Send()
@@ -105,8 +313,152 @@ func (l *RedisGob[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
 	return nil
 }
 
+// Set values along with their metadata
+// Versioned values are only stored if they are newer than the stored value and leased values are only stored
+// if their lease is still held, versions are stored in separate keys with the same expiration as the values
+func (l *RedisGob[TKey, TValue]) SetEntries(keys []TKey, entries []lapis.Entry[TValue]) []error {
+	errors := make([]error, len(keys))
+	keysString := stringifyKeys(keys, l.config.KeyPrefix)
+	scriptKeys := make([]string, 0, 3*len(keys))
+	scriptArguments := []string{strconv.FormatInt(l.config.Retention.Milliseconds(), 10)}
+	scriptIndexes := make([]int, 0, len(keys))
+	for i, entry := range entries {
+		encoded, err := l.encode(entry.Value)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		scriptKeys = append(scriptKeys, keysString[i], keysString[i]+RedisVersionSuffix, keysString[i]+RedisLeaseSuffix)
+		scriptArguments = append(scriptArguments, encoded, strconv.FormatInt(entry.Version, 10), strconv.FormatUint(uint64(entry.Lease), 10), strconv.Itoa(len(entry.Tags)))
+		for _, tag := range entry.Tags {
+			scriptArguments = append(scriptArguments, l.tagKey(tag))
+		}
+		scriptIndexes = append(scriptIndexes, i)
+	}
+	if len(scriptIndexes) == 0 {
+		return errors
+	}
+
+	results := make([]int, 0, len(scriptIndexes))
+	script := radix.NewEvalScript(len(scriptKeys), redisSetEntriesScript)
+	if err := l.config.Connection.Do(script.Cmd(&results, append(scriptKeys, scriptArguments...)...)); err != nil {
+		for _, i := range scriptIndexes {
+			errors[i] = err
+		}
+		return errors
+	}
+	for j, i := range scriptIndexes {
+		if j < len(results) {
+			switch results[j] {
+			case 0:
+				errors[i] = lapis.ErrStaleVersion
+			case 2:
+				errors[i] = lapis.ErrInvalidLease
+			}
+		}
+	}
+	return errors
+}
+
+// Evict every value stored with any of the given tags
+// Keys that were stored again without a tag are still evicted since tag sets are only cleaned up when they expire
+// Tags are only supported on a single redis node, since the keys of a tag may be in any cluster slot
+func (l *RedisGob[TKey, TValue]) InvalidateTags(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	script := radix.NewEvalScript(len(tags), redisInvalidateTagsScript)
+	return l.config.Connection.Do(script.Cmd(nil, append(mapFn(tags, l.tagKey), RedisVersionSuffix, RedisLeaseSuffix)...))
+}
+
+// Get a key source scanning every key held by the layer, such as to warm a store with lapis.Store.Warm
+// Scanned keys are stripped of the key prefix and converted with the given parse function
+func (l *RedisGob[TKey, TValue]) ScanKeys(parse func(key string) (TKey, error)) lapis.KeySource[TKey] {
+	return &redisKeySource[TKey]{
+		scanner: radix.NewScanner(l.config.Connection, radix.ScanOpts{
+			Command: "SCAN",
+			Pattern: l.config.KeyPrefix + "*",
+			Count:   redisScanCount,
+		}),
+		prefix: l.config.KeyPrefix,
+		parse:  parse,
+	}
+}
+
+// number of keys scanned at once
+const redisScanCount = 256
+
+// a key source scanning redis keys
+type redisKeySource[TKey comparable] struct {
+	scanner radix.Scanner
+	prefix  string
+	parse   func(key string) (TKey, error)
+}
+
+func (s *redisKeySource[TKey]) NextKeys(ctx context.Context) ([]TKey, error) {
+	keys := make([]TKey, 0, redisScanCount)
+	var raw string
+	for len(keys) < redisScanCount && s.scanner.Next(&raw) {
+		// skip the keys holding the metadata of the values
+		if strings.HasSuffix(raw, RedisVersionSuffix) || strings.HasSuffix(raw, RedisLeaseSuffix) || strings.HasPrefix(raw, s.prefix+RedisTagPrefix) {
+			continue
+		}
+		key, err := s.parse(strings.TrimPrefix(raw, s.prefix))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, s.scanner.Close()
+	}
+	return keys, ctx.Err()
+}
+
+// get the key of the set holding the keys stored with the given tag
+func (l *RedisGob[TKey, TValue]) tagKey(tag string) string {
+	return l.config.KeyPrefix + RedisTagPrefix + tag
+}
+
+// encode a value with the codec of the layer
+func (l *RedisGob[TKey, TValue]) encode(value TValue) (string, error) {
+	b, err := encodeValue(l.config.Codec, value)
+	return string(b), err
+}
+
+// encode a value with a codec, nil values are encoded as the nil constant since codecs may not support them
+func encodeValue[TValue any](codec lapis.Codec, value TValue) ([]byte, error) {
+	if isNil(value) {
+		return []byte(RedisNilValue), nil
+	}
+	return codec.Marshal(value)
+}
+
+// decode a value encoded by encodeValue
+func decodeValue[TValue any](codec lapis.Codec, data []byte, target *TValue) error {
+	if string(data) == RedisNilValue {
+		var zeroValue TValue
+		*target = zeroValue
+		return nil
+	}
+	return codec.Unmarshal(data, target)
+}
+
+// check if a value is a nil pointer or a nil interface
+func isNil[TValue any](value TValue) bool {
+	v := reflect.ValueOf(&value).Elem()
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
 // Create a new redis data layer
 func NewRedis[TKey comparable, TValue any](config RedisConfig) *RedisGob[TKey, TValue] {
+	if config.Codec == nil {
+		config.Codec = lapis.GobCodec{}
+	}
 	l := &RedisGob[TKey, TValue]{
 		config: config,
 	}
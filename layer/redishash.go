@@ -0,0 +1,274 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/mediocregopher/radix/v3"
+)
+
+// Replaces the hash of a value with the given fields
+// KEYS: the hash key
+// ARGV: retention in milliseconds, followed by pairs of field and value
+var redisHashSetScript = `
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+local retention = tonumber(ARGV[1])
+if retention > 0 then
+	redis.call('PEXPIRE', KEYS[1], retention)
+end
+return 1
+`
+
+// Updates fields of the hash of a value if the hash exists and does not hold a nil value
+// KEYS: the hash key
+// ARGV: the nil field, followed by pairs of field and value
+// Results: 1 = updated, 0 = the hash does not exist or holds a nil value
+var redisHashSetFieldsScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 or redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+return 1
+`
+
+// FieldCodec converts values to and from the fields of a redis hash
+type FieldCodec[TValue any] interface {
+	// Encode a value into fields
+	Encode(value TValue) (map[string]string, error)
+
+	// Decode a value from fields, fields that are missing are left as zero values
+	Decode(fields map[string]string) (TValue, error)
+
+	// Encode the value of a single field
+	EncodeField(name string, value any) (string, error)
+}
+
+// StructFieldCodec encodes each exported field of a struct, or a pointer to a struct, as a hash field
+// The field name can be changed with the lapis struct tag, and fields tagged with lapis:"-" are skipped
+type StructFieldCodec[TValue any] struct {
+	// Codec used to encode each field, defaults to lapis.JSONCodec
+	Codec lapis.Codec
+}
+
+// Indicates that a field does not exist in the struct
+type ErrUnknownField struct {
+	Field string
+}
+
+func (e ErrUnknownField) Error() string {
+	return fmt.Sprintf("redis hash layer: unknown field %s", e.Field)
+}
+
+func (c StructFieldCodec[TValue]) Encode(value TValue) (map[string]string, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("redis hash layer: %s is not a struct", v.Type())
+	}
+	fields := make(map[string]string, v.NumField())
+	for name, index := range structFields(v.Type()) {
+		encoded, err := c.codec().Marshal(v.Field(index).Interface())
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = string(encoded)
+	}
+	return fields, nil
+}
+
+func (c StructFieldCodec[TValue]) Decode(fields map[string]string) (TValue, error) {
+	var value TValue
+	v := reflect.ValueOf(&value).Elem()
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return value, fmt.Errorf("redis hash layer: %s is not a struct", v.Type())
+	}
+	for name, index := range structFields(v.Type()) {
+		if encoded, ok := fields[name]; ok {
+			if err := c.codec().Unmarshal([]byte(encoded), v.Field(index).Addr().Interface()); err != nil {
+				return value, err
+			}
+		}
+	}
+	return value, nil
+}
+
+func (c StructFieldCodec[TValue]) EncodeField(name string, value any) (string, error) {
+	t := reflect.TypeOf((*TValue)(nil)).Elem()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if _, ok := structFields(t)[name]; !ok {
+		return "", ErrUnknownField{Field: name}
+	}
+	encoded, err := c.codec().Marshal(value)
+	return string(encoded), err
+}
+
+func (c StructFieldCodec[TValue]) codec() lapis.Codec {
+	if c.Codec == nil {
+		return lapis.JSONCodec{}
+	}
+	return c.Codec
+}
+
+// get the hash field names of the exported fields of a struct type and their indexes
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("lapis"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// Configuration for the redis hash data layer
+type RedisHashConfig[TValue any] struct {
+	// The duration of the cached data, set 0 to disable expiration
+	Retention time.Duration
+
+	// Connection to redis
+	Connection *radix.Pool
+
+	// Key prefix to be used in redis keys
+	KeyPrefix string
+
+	// Codec converting values to hash fields, defaults to StructFieldCodec
+	FieldCodec FieldCodec[TValue]
+}
+
+// RedisHash layer is redis-backed cache layer storing each value as a hash with one field per struct field, which
+// allows updating single fields with SetFields
+type RedisHash[TKey comparable, TValue any] struct {
+	config RedisHashConfig[TValue]
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *RedisHash[TKey, TValue]) Identifier() string { return "redis-hash" }
+
+// The function that will be used to resolve a set of keys, the hashes are loaded with pipelined HGETALL commands
+func (l *RedisHash[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	hashes := make([]map[string]string, len(keys))
+	commands := make([]radix.CmdAction, len(keys))
+	for i, key := range stringifyKeys(keys, l.config.KeyPrefix) {
+		commands[i] = radix.Cmd(&hashes[i], "HGETALL", key)
+	}
+	if err := l.config.Connection.Do(radix.Pipeline(commands...)); err != nil {
+		fillArray(errors, err)
+		return result, errors
+	}
+	for i, k := range keys {
+		if len(hashes[i]) == 0 {
+			errors[i] = lapis.NewErrNotFound(k)
+			continue
+		}
+		// handle nil values since they are stored as a hash with the nil constant as the only field
+		if _, ok := hashes[i][RedisNilValue]; ok {
+			continue
+		}
+		value, err := l.config.FieldCodec.Decode(hashes[i])
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		result[i] = value
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, the hash of each value is replaced atomically
+func (l *RedisHash[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	errors := make([]error, len(keys))
+	retention := strconv.FormatInt(l.config.Retention.Milliseconds(), 10)
+	commands := make([]radix.CmdAction, 0, len(keys))
+	for i, key := range stringifyKeys(keys, l.config.KeyPrefix) {
+		fields := map[string]string{RedisNilValue: "1"}
+		if !isNil(values[i]) {
+			var err error
+			if fields, err = l.config.FieldCodec.Encode(values[i]); err != nil {
+				errors[i] = err
+				continue
+			}
+		}
+		if len(fields) == 0 {
+			errors[i] = errRedisHashEmpty
+			continue
+		}
+		arguments := []string{retention}
+		for field, value := range fields {
+			arguments = append(arguments, field, value)
+		}
+		// EVAL is used instead of EVALSHA since scripts with a fallback can't be pipelined
+		commands = append(commands, radix.Cmd(nil, "EVAL", append([]string{redisHashSetScript, "1", key}, arguments...)...))
+	}
+	if len(commands) == 0 {
+		return errors
+	}
+	if err := l.config.Connection.Do(radix.Pipeline(commands...)); err != nil {
+		for i := range errors {
+			if errors[i] == nil {
+				errors[i] = err
+			}
+		}
+	}
+	return errors
+}
+
+// Update fields of a stored value without encoding the whole value, the value must already be stored and not be nil,
+// otherwise lapis.ErrNotFound is returned so a partial value is never stored
+func (l *RedisHash[TKey, TValue]) SetFields(key TKey, fields map[string]any) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	arguments := []string{stringifyKeys([]TKey{key}, l.config.KeyPrefix)[0], RedisNilValue}
+	for field, value := range fields {
+		encoded, err := l.config.FieldCodec.EncodeField(field, value)
+		if err != nil {
+			return err
+		}
+		arguments = append(arguments, field, encoded)
+	}
+	var updated int
+	if err := l.config.Connection.Do(radix.NewEvalScript(1, redisHashSetFieldsScript).Cmd(&updated, arguments...)); err != nil {
+		return err
+	}
+	if updated == 0 {
+		return lapis.NewErrNotFound(key)
+	}
+	return nil
+}
+
+// indicates that a value has no fields, which can't be told apart from a missing hash
+var errRedisHashEmpty = errors.New("redis hash layer: values must have at least one field")
+
+// Create a new redis hash data layer
+func NewRedisHash[TKey comparable, TValue any](config RedisHashConfig[TValue]) *RedisHash[TKey, TValue] {
+	if config.FieldCodec == nil {
+		config.FieldCodec = StructFieldCodec[TValue]{}
+	}
+	return &RedisHash[TKey, TValue]{
+		config: config,
+	}
+}
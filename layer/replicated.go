@@ -0,0 +1,248 @@
+package layer
+
+import (
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// Order in which the replicas of a replicated layer are read
+type ReadStrategy int
+
+const (
+	ReadPrimaryFirst  ReadStrategy = iota // Replicas are read in the configured order
+	ReadRandom                            // Replicas are read in a random order for every batch
+	ReadLowestLatency                     // Replicas are read in the order of their average latency
+)
+
+// Configuration for the replicated layer
+type ReplicatedConfig[TKey comparable, TValue any] struct {
+	// The replicas holding the same keys, the first replica is the primary
+	Replicas []lapis.Layer[TKey, TValue]
+
+	// Order in which the replicas are read, defaults to ReadPrimaryFirst
+	Strategy ReadStrategy
+
+	// Weight of the latest call in the average latency of a replica, defaults to 0.2
+	LatencyDecay float64
+
+	// Number of consecutive failed calls after which a replica is unhealthy, defaults to 3
+	// Unhealthy replicas are read after the healthy ones
+	FailureThreshold int
+
+	// Duration after which an unhealthy replica is read again in its normal order, defaults to 10 seconds
+	RetryInterval time.Duration
+
+	// Identifier of the layer, defaults to replicated
+	Identifier string
+}
+
+// Replicated layer sets values to all of its replicas and reads from the preferred replica, keys that are missing or
+// failing in a replica are read from the next replica
+type Replicated[TKey comparable, TValue any] struct {
+	config ReplicatedConfig[TKey, TValue]
+	health []replicaHealth
+	mu     sync.Mutex
+}
+
+// health and latency of a replica
+type replicaHealth struct {
+	latency        time.Duration // average latency of the successful reads
+	failures       int           // number of consecutive failed calls
+	unhealthyUntil time.Time     // time until the replica is read after the healthy ones
+}
+
+// Health of a replica of a replicated layer
+type ReplicaHealth struct {
+	Healthy  bool
+	Latency  time.Duration // average latency of the successful reads
+	Failures int           // number of consecutive failed calls
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *Replicated[TKey, TValue]) Identifier() string { return l.config.Identifier }
+
+// The function that will be used to resolve a set of keys, the replicas are read in the order of the strategy
+// until every key is found or all replicas are read
+func (l *Replicated[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	indexes := make([]int, len(keys))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	pendingKeys := keys
+	for _, replica := range l.order() {
+		start := time.Now()
+		values, replicaErrors := l.getReplica(replica, pendingKeys)
+		failed := false
+		var missingIndexes []int
+		var missingKeys []TKey
+		for j, i := range indexes {
+			var err error
+			if len(replicaErrors) > 0 {
+				err = replicaErrors[j]
+			}
+			if err == nil {
+				result[i] = values[j]
+				errors[i] = nil
+				continue
+			}
+			if _, ok := err.(lapis.ErrNotFound[TKey]); !ok {
+				failed = true
+			}
+			errors[i] = err
+			missingIndexes = append(missingIndexes, i)
+			missingKeys = append(missingKeys, pendingKeys[j])
+		}
+		l.record(replica, time.Since(start), failed)
+		if len(missingIndexes) == 0 {
+			break
+		}
+		indexes, pendingKeys = missingIndexes, missingKeys
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, the values are set to all replicas in parallel
+// A key fails if it fails in any replica
+func (l *Replicated[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	var errors []error
+	var mu sync.Mutex
+	wg := sync.WaitGroup{}
+	wg.Add(len(l.config.Replicas))
+	for replica := range l.config.Replicas {
+		capturedReplica := replica
+		go func() {
+			defer wg.Done()
+			replicaErrors := l.setReplica(capturedReplica, keys, values)
+			failed := false
+			for _, err := range replicaErrors {
+				if err != nil {
+					failed = true
+					break
+				}
+			}
+			l.record(capturedReplica, 0, failed)
+			if !failed {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if errors == nil {
+				errors = make([]error, len(keys))
+			}
+			for i, err := range replicaErrors {
+				if errors[i] == nil {
+					errors[i] = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors
+}
+
+// get the keys from a replica, a panic of the replica is recovered and fails every key with a lapis.ErrLayerPanic
+// so the keys are read from the next replica
+func (l *Replicated[TKey, TValue]) getReplica(replica int, keys []TKey) (values []TValue, errors []error) {
+	defer func() {
+		if v := recover(); v != nil {
+			values = make([]TValue, len(keys))
+			errors = fillArray(make([]error, len(keys)), l.replicaPanic(replica, v))
+		}
+	}()
+	return l.config.Replicas[replica].Get(keys)
+}
+
+// set the keys to a replica, a panic of the replica is recovered and fails every key with a lapis.ErrLayerPanic since
+// sets run in their own goroutines out of the reach of the store
+func (l *Replicated[TKey, TValue]) setReplica(replica int, keys []TKey, values []TValue) (errors []error) {
+	defer func() {
+		if v := recover(); v != nil {
+			errors = fillArray(make([]error, len(keys)), l.replicaPanic(replica, v))
+		}
+	}()
+	return l.config.Replicas[replica].Set(keys, values)
+}
+
+// create the error of a panicking replica
+func (l *Replicated[TKey, TValue]) replicaPanic(replica int, v any) error {
+	return lapis.ErrLayerPanic{Layer: l.config.Replicas[replica].Identifier(), Value: v, Stack: debug.Stack()}
+}
+
+// Get the health of each replica
+func (l *Replicated[TKey, TValue]) Health() []ReplicaHealth {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	health := make([]ReplicaHealth, len(l.health))
+	for i, h := range l.health {
+		health[i] = ReplicaHealth{Healthy: !now.Before(h.unhealthyUntil), Latency: h.latency, Failures: h.failures}
+	}
+	return health
+}
+
+// get the order in which the replicas are read, unhealthy replicas are moved after the healthy ones
+func (l *Replicated[TKey, TValue]) order() []int {
+	order := make([]int, len(l.config.Replicas))
+	for i := range order {
+		order[i] = i
+	}
+	if l.config.Strategy == ReadRandom {
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := l.health[order[i]], l.health[order[j]]
+		if aHealthy, bHealthy := !now.Before(a.unhealthyUntil), !now.Before(b.unhealthyUntil); aHealthy != bHealthy {
+			return aHealthy
+		}
+		return l.config.Strategy == ReadLowestLatency && a.latency < b.latency
+	})
+	return order
+}
+
+// record the result of a call to a replica, only the latency of reads is averaged so sets record a latency of 0
+func (l *Replicated[TKey, TValue]) record(replica int, latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := &l.health[replica]
+	if failed {
+		h.failures++
+		if h.failures >= l.config.FailureThreshold {
+			h.unhealthyUntil = time.Now().Add(l.config.RetryInterval)
+		}
+		return
+	}
+	h.failures = 0
+	h.unhealthyUntil = time.Time{}
+	if latency == 0 {
+		return
+	}
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = time.Duration(l.config.LatencyDecay*float64(latency) + (1-l.config.LatencyDecay)*float64(h.latency))
+	}
+}
+
+// Create a new replicated layer
+func NewReplicated[TKey comparable, TValue any](config ReplicatedConfig[TKey, TValue]) *Replicated[TKey, TValue] {
+	config.Identifier = fallback.Zero(config.Identifier, "replicated")
+	config.LatencyDecay = fallback.Zero(config.LatencyDecay, 0.2)
+	config.FailureThreshold = fallback.Zero(config.FailureThreshold, 3)
+	config.RetryInterval = fallback.Zero(config.RetryInterval, 10*time.Second)
+	return &Replicated[TKey, TValue]{
+		config: config,
+		health: make([]replicaHealth, len(config.Replicas)),
+	}
+}
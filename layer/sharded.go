@@ -0,0 +1,211 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// A layer in a sharded layer
+type Shard[TKey comparable, TValue any] struct {
+	// The layer holding the keys of this shard
+	Layer lapis.Layer[TKey, TValue]
+
+	// Name of the shard on the hash ring, defaults to the layer identifier followed by the shard index
+	// Names should be set when shards may be reordered, since keys are placed on the ring by the shard names
+	Name string
+
+	// Relative share of the keys held by this shard, defaults to 1
+	Weight int
+}
+
+// Configuration for the sharded layer
+type ShardedConfig[TKey comparable, TValue any] struct {
+	// The shards to spread the keys across
+	Shards []Shard[TKey, TValue]
+
+	// Number of points of each shard on the hash ring per unit of weight, defaults to 160
+	VirtualNodes int
+
+	// Hash a key, defaults to FNV-1a of the formatted key
+	Hash func(key TKey) uint64
+
+	// Identifier of the layer, defaults to sharded
+	Identifier string
+}
+
+// Sharded layer spreads keys across multiple layers with a consistent hash ring, so adding or removing a shard only
+// moves the keys of about one shard
+type Sharded[TKey comparable, TValue any] struct {
+	config ShardedConfig[TKey, TValue]
+	ring   []ringNode
+}
+
+// a point on the hash ring
+type ringNode struct {
+	hash  uint64
+	shard int
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *Sharded[TKey, TValue]) Identifier() string { return l.config.Identifier }
+
+// The function that will be used to resolve a set of keys, the keys of each shard are loaded in parallel
+func (l *Sharded[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	panics := l.fanOut(keys, func(shard int, indexes []int, shardKeys []TKey) {
+		values, shardErrors := l.config.Shards[shard].Layer.Get(shardKeys)
+		for j, i := range indexes {
+			result[i] = values[j]
+			if len(shardErrors) > 0 {
+				errors[i] = shardErrors[j]
+			}
+		}
+	})
+	for i, err := range panics {
+		if err != nil {
+			errors[i] = err
+		}
+	}
+	return result, errors
+}
+
+// The function that will be called for successful resolvers, the keys of each shard are set in parallel
+func (l *Sharded[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	var errors []error
+	var mu sync.Mutex
+	panics := l.fanOut(keys, func(shard int, indexes []int, shardKeys []TKey) {
+		shardValues := make([]TValue, len(indexes))
+		for j, i := range indexes {
+			shardValues[j] = values[i]
+		}
+		shardErrors := l.config.Shards[shard].Layer.Set(shardKeys, shardValues)
+		if len(shardErrors) == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if errors == nil {
+			errors = make([]error, len(keys))
+		}
+		for j, i := range indexes {
+			errors[i] = shardErrors[j]
+		}
+	})
+	if panics != nil && errors == nil {
+		errors = make([]error, len(keys))
+	}
+	for i, err := range panics {
+		if err != nil {
+			errors[i] = err
+		}
+	}
+	return errors
+}
+
+// Get the index of the shard holding the given key
+func (l *Sharded[TKey, TValue]) ShardOf(key TKey) int {
+	hash := l.config.Hash(key)
+	i := sort.Search(len(l.ring), func(i int) bool { return l.ring[i].hash >= hash })
+	if i == len(l.ring) {
+		i = 0
+	}
+	return l.ring[i].shard
+}
+
+// group the keys by their shards and call fn for each shard in parallel, indexes map the keys of the shard to
+// the given keys
+// A panic of a shard is recovered and returned as a lapis.ErrLayerPanic for each of its keys, the returned array is
+// nil if no shard panicked
+func (l *Sharded[TKey, TValue]) fanOut(keys []TKey, fn func(shard int, indexes []int, shardKeys []TKey)) []error {
+	indexes := make([][]int, len(l.config.Shards))
+	shardKeys := make([][]TKey, len(l.config.Shards))
+	for i, key := range keys {
+		shard := l.ShardOf(key)
+		indexes[shard] = append(indexes[shard], i)
+		shardKeys[shard] = append(shardKeys[shard], key)
+	}
+	var panics []error
+	var mu sync.Mutex
+	wg := sync.WaitGroup{}
+	for shard := range l.config.Shards {
+		if len(indexes[shard]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		capturedShard := shard
+		go func() {
+			defer wg.Done()
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				err := lapis.ErrLayerPanic{Layer: l.config.Shards[capturedShard].Layer.Identifier(), Value: v, Stack: debug.Stack()}
+				mu.Lock()
+				defer mu.Unlock()
+				if panics == nil {
+					panics = make([]error, len(keys))
+				}
+				for _, i := range indexes[capturedShard] {
+					panics[i] = err
+				}
+			}()
+			fn(capturedShard, indexes[capturedShard], shardKeys[capturedShard])
+		}()
+	}
+	wg.Wait()
+	return panics
+}
+
+// hash a string with FNV-1a, mixing the result so similar strings are spread across the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// spread the bits of a hash with the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Indicates that a sharded layer has no shard with a positive weight, so no key can be placed on the ring
+var ErrShardedEmpty = errors.New("sharded layer: at least one shard with a positive weight is required")
+
+// Create a new sharded layer
+func NewSharded[TKey comparable, TValue any](config ShardedConfig[TKey, TValue]) (*Sharded[TKey, TValue], error) {
+	config.Identifier = fallback.Zero(config.Identifier, "sharded")
+	config.VirtualNodes = fallback.Zero(config.VirtualNodes, 160)
+	if config.Hash == nil {
+		config.Hash = func(key TKey) uint64 { return hashString(fmt.Sprint(key)) }
+	}
+	l := &Sharded[TKey, TValue]{config: config}
+	for shard, s := range config.Shards {
+		name := s.Name
+		if name == "" {
+			name = s.Layer.Identifier() + "-" + strconv.Itoa(shard)
+		}
+		for i := 0; i < fallback.Zero(s.Weight, 1)*config.VirtualNodes; i++ {
+			l.ring = append(l.ring, ringNode{hash: hashString(name + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	if len(l.ring) == 0 {
+		return nil, ErrShardedEmpty
+	}
+	sort.Slice(l.ring, func(i, j int) bool { return l.ring[i].hash < l.ring[j].hash })
+	return l, nil
+}
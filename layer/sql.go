@@ -0,0 +1,160 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowscan/lapis"
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// Placeholder of the keys in the query that will be replaced by the keys of each batch
+const SQLKeysPlaceholder = "{keys}"
+
+// Style of the query parameters used for the keys
+type SQLParameterStyle int
+
+const (
+	SQLQuestion SQLParameterStyle = iota // Keys are passed as IN (?, ?, ?), used by SQLite and MySQL
+	SQLDollar                            // Keys are passed as IN ($1, $2, $3), used by PostgreSQL
+	SQLAny                               // Keys are passed as a single array parameter in = ANY($1), used by PostgreSQL
+)
+
+// Configuration for the SQL data layer
+type SQLConfig[TKey comparable, TValue any] struct {
+	// Connection to the database
+	DB *sql.DB
+
+	// Query template containing SQLKeysPlaceholder, which is replaced by the parameters of the keys of each batch,
+	// e.g. SELECT id, name FROM users WHERE id IN ({keys}) or SELECT id, name FROM users WHERE id = ANY({keys})
+	Query string
+
+	// Style of the parameters of the keys, defaults to SQLQuestion
+	ParameterStyle SQLParameterStyle
+
+	// Convert the keys of a batch into a single array parameter for SQLAny, such as pq.Array
+	Array func(keys []TKey) any
+
+	// Scan the current row into a value
+	Scan func(rows *sql.Rows) (TValue, error)
+
+	// Extract the key of a scanned value to match the rows back to the keys
+	Key func(value TValue) TKey
+
+	// Maximum number of keys in one query, larger batches are split into multiple queries, 0 = no limit
+	// Some databases limit the number of parameters, such as 999 in older versions of SQLite
+	MaxKeys int
+
+	// Timeout of each query, 0 = no timeout
+	Timeout time.Duration
+
+	// Identifier of the layer, defaults to sql
+	Identifier string
+}
+
+// SQL layer loads values from a database with one query per batch, it is meant to be used as the final layer
+type SQL[TKey comparable, TValue any] struct {
+	config SQLConfig[TKey, TValue]
+}
+
+// Unique identifier for this layer used for logging and metric purposes
+func (l *SQL[TKey, TValue]) Identifier() string { return l.config.Identifier }
+
+// The function that will be used to resolve a set of keys, keys without a row will have lapis.ErrNotFound
+func (l *SQL[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	errors := make([]error, len(keys))
+	chunkSize := len(keys)
+	if l.config.MaxKeys > 0 && l.config.MaxKeys < chunkSize {
+		chunkSize = l.config.MaxKeys
+	}
+	for start := 0; start < len(keys); start += chunkSize {
+		end := start + chunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		l.query(keys[start:end], result[start:end], errors[start:end])
+	}
+	return result, errors
+}
+
+// load the values of a set of keys with a single query
+func (l *SQL[TKey, TValue]) query(keys []TKey, result []TValue, errors []error) {
+	ctx := context.Background()
+	if l.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.Timeout)
+		defer cancel()
+	}
+
+	query, args := l.build(keys)
+	rows, err := l.config.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		fillArray(errors, err)
+		return
+	}
+	defer rows.Close()
+
+	values := make(map[TKey]TValue, len(keys))
+	for rows.Next() {
+		value, err := l.config.Scan(rows)
+		if err != nil {
+			fillArray(errors, err)
+			return
+		}
+		values[l.config.Key(value)] = value
+	}
+	if err := rows.Err(); err != nil {
+		fillArray(errors, err)
+		return
+	}
+
+	for i, k := range keys {
+		if value, ok := values[k]; ok {
+			result[i] = value
+		} else {
+			errors[i] = lapis.NewErrNotFound(k)
+		}
+	}
+}
+
+// build the query and its arguments for a set of keys
+func (l *SQL[TKey, TValue]) build(keys []TKey) (string, []any) {
+	if l.config.ParameterStyle == SQLAny {
+		return strings.Replace(l.config.Query, SQLKeysPlaceholder, "$1", 1), []any{l.config.Array(keys)}
+	}
+	parameters := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, k := range keys {
+		if l.config.ParameterStyle == SQLDollar {
+			parameters[i] = "$" + strconv.Itoa(i+1)
+		} else {
+			parameters[i] = "?"
+		}
+		args[i] = k
+	}
+	return strings.Replace(l.config.Query, SQLKeysPlaceholder, strings.Join(parameters, ", "), 1), args
+}
+
+// The SQL layer is the source of truth, so primed values are ignored
+func (l *SQL[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	return nil
+}
+
+// Indicates that the SQLAny parameter style is used without an Array function to convert the keys
+var ErrSQLNoArray = errors.New("sql layer: SQLAny requires an Array function")
+
+// Create a new SQL data layer
+func NewSQL[TKey comparable, TValue any](config SQLConfig[TKey, TValue]) (*SQL[TKey, TValue], error) {
+	if config.ParameterStyle == SQLAny && config.Array == nil {
+		return nil, ErrSQLNoArray
+	}
+	config.Identifier = fallback.Zero(config.Identifier, "sql")
+	return &SQL[TKey, TValue]{
+		config: config,
+	}, nil
+}
@@ -0,0 +1,99 @@
+package lapis
+
+import "time"
+
+// load values from a lease layer, keys that are being loaded by another loader are retried until they are
+// filled, a lease is issued, or the retries are exhausted
+func (r *Store[TKey, TValue]) getLeased(layer LeaseLayer[TKey, TValue], keys []TKey) ([]TValue, []Lease, []error) {
+	values, leases, errors := layer.GetLeased(keys)
+	for attempt := 0; attempt < r.leaseRetries; attempt++ {
+		var hotIndexes []int
+		for i := range errors {
+			if errors[i] == ErrHotMiss {
+				hotIndexes = append(hotIndexes, i)
+			}
+		}
+		if len(hotIndexes) == 0 {
+			break
+		}
+
+		time.Sleep(r.leaseWait)
+		retryValues, retryLeases, retryErrors := layer.GetLeased(extract(keys, hotIndexes))
+		if leases == nil && retryLeases != nil {
+			leases = make([]Lease, len(keys))
+		}
+		for j, i := range hotIndexes {
+			values[i] = retryValues[j]
+			if retryLeases != nil {
+				leases[i] = retryLeases[j]
+			}
+			if len(retryErrors) > 0 {
+				errors[i] = retryErrors[j]
+			} else {
+				errors[i] = nil
+			}
+		}
+	}
+	return values, leases, errors
+}
+
+// leases issued by the layers for the keys being resolved
+type resolveLeases struct {
+	leases [][]Lease // leases issued by each layer, indexed by the result index
+	denied [][]bool  // keys that another loader holds a lease for on each layer, they won't be primed
+}
+
+// record the leases issued by a layer, resultIndexes maps the layer keys to the result indexes
+func (l *resolveLeases) record(layerCount int, keysCount int, layerIndex int, resultIndexes []int, leases []Lease, errors []error) {
+	if leases == nil {
+		return
+	}
+	if l.leases == nil {
+		l.leases = make([][]Lease, layerCount)
+		l.denied = make([][]bool, layerCount)
+	}
+	l.leases[layerIndex] = make([]Lease, keysCount)
+	l.denied[layerIndex] = make([]bool, keysCount)
+	for i, resultIndex := range resultIndexes {
+		l.leases[layerIndex][resultIndex] = leases[i]
+		if len(errors) > 0 && errors[i] == ErrHotMiss {
+			l.denied[layerIndex][resultIndex] = true
+		}
+	}
+}
+
+// get the leases issued by a layer and the keys denied by the layer
+func (l *resolveLeases) of(layerIndex int) ([]Lease, []bool) {
+	if l.leases == nil {
+		return nil, nil
+	}
+	return l.leases[layerIndex], l.denied[layerIndex]
+}
+
+// prime a layer with resolved values, keys leased by the layer are primed with their leases and
+// keys that another loader holds a lease for are not primed
+// generations are the derived generations of the keys before they were resolved, indexed by the result indexes
+func (r *Store[TKey, TValue]) prime(traceID uint64, layerIndex int, leases []Lease, denied []bool, generations []uint64, resultIndexes []int, keys []TKey, values []TValue) {
+	if leases == nil {
+		r.layerSet(traceID, layerIndex, keys, values, nil)
+		r.evictInvalidated(traceID, layerIndex, generations, resultIndexes, keys)
+		return
+	}
+	primeIndexes := make([]int, 0, len(keys))
+	primeKeys := make([]TKey, 0, len(keys))
+	primeValues := make([]TValue, 0, len(keys))
+	primeLeases := make([]Lease, 0, len(keys))
+	for i, resultIndex := range resultIndexes {
+		if denied[resultIndex] {
+			continue
+		}
+		primeIndexes = append(primeIndexes, resultIndex)
+		primeKeys = append(primeKeys, keys[i])
+		primeValues = append(primeValues, values[i])
+		primeLeases = append(primeLeases, leases[resultIndex])
+	}
+	if len(primeKeys) > 0 {
+		r.layerSet(traceID, layerIndex, primeKeys, primeValues, primeLeases)
+		r.evictInvalidated(traceID, layerIndex, generations, primeIndexes, primeKeys)
+	}
+}
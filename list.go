@@ -0,0 +1,154 @@
+package lapis
+
+import "fmt"
+
+// Prefix of the tags identifying the ID lists of a parent
+const ListParentTagPrefix = "__lapis_parent:"
+
+// Page of a list
+type Page struct {
+	Offset int
+	Limit  int // maximum number of items, 0 = no limit
+}
+
+// Key of a page of the children of a parent, such as a page of the posts of an author
+type ListKey[TParent comparable] struct {
+	Parent TParent
+	Page   Page
+}
+
+// Configuration for a list store
+type ListConfig[TParent comparable, TID comparable, TValue any] struct {
+	// Configuration of the store of the ID lists, the layers cache the ID lists and Load is added as the final layer
+	Config[ListKey[TParent], []TID]
+
+	// Load the IDs of the children of a batch of list keys, such as with one query for all of the parents
+	Load func(keys []ListKey[TParent]) ([][]TID, []error)
+
+	// Store of the children, shared with point loads of the children
+	Entities *Store[TID, TValue]
+}
+
+// ListStore loads one-to-many relationships, the ID lists are cached separately from the children, which are
+// loaded through the entity store
+type ListStore[TParent comparable, TID comparable, TValue any] struct {
+	ids      *Store[ListKey[TParent], []TID]
+	entities *Store[TID, TValue]
+}
+
+// Load a page of the children of a parent
+func (r *ListStore[TParent, TID, TValue]) Load(parent TParent, page Page, options ...LoadOption) ([]TValue, error) {
+	values, errors := r.LoadAll([]ListKey[TParent]{{Parent: parent, Page: page}}, options...)
+	return values[0], errors[0]
+}
+
+// Load a set of lists, the children of all lists are loaded with a single load on the entity store
+// Children that are not found, such as children deleted after the list was cached, are left out of the lists
+// The load options only apply to loading the ID lists
+func (r *ListStore[TParent, TID, TValue]) LoadAll(keys []ListKey[TParent], options ...LoadOption) ([][]TValue, []error) {
+	idLists, errors := r.ids.LoadAll(keys, options...)
+
+	// collect the unique IDs of all lists
+	var ids []TID
+	indexes := make(map[TID]int)
+	for i, idList := range idLists {
+		if errors[i] != nil {
+			continue
+		}
+		for _, id := range idList {
+			if _, ok := indexes[id]; !ok {
+				indexes[id] = len(ids)
+				ids = append(ids, id)
+			}
+		}
+	}
+	var values []TValue
+	var entityErrors []error
+	if len(ids) > 0 {
+		values, entityErrors = r.entities.LoadAll(ids)
+	}
+
+	result := make([][]TValue, len(keys))
+	for i, idList := range idLists {
+		if errors[i] != nil {
+			continue
+		}
+		result[i] = make([]TValue, 0, len(idList))
+		for _, id := range idList {
+			index := indexes[id]
+			if err := entityErrors[index]; err != nil {
+				if _, ok := err.(ErrNotFound[TID]); ok {
+					continue
+				}
+				result[i], errors[i] = nil, err
+				break
+			}
+			result[i] = append(result[i], values[index])
+		}
+	}
+	return result, errors
+}
+
+// Evict every cached page of the given parents from the layers implementing TagLayer, such as after a child is added
+// Returns an array of errors with each item represents an error returned by a layer
+func (r *ListStore[TParent, TID, TValue]) InvalidateParents(parents ...TParent) []error {
+	tags := make([]string, len(parents))
+	for i, parent := range parents {
+		tags[i] = listParentTag(parent)
+	}
+	return r.ids.InvalidateTags(tags)
+}
+
+// Get the store of the ID lists, such as to prime or refresh the ID lists
+func (r *ListStore[TParent, TID, TValue]) IDs() *Store[ListKey[TParent], []TID] {
+	return r.ids
+}
+
+// Stop the background goroutines of the store of the ID lists, the entity store is not closed since it is shared
+func (r *ListStore[TParent, TID, TValue]) Close() error {
+	return r.ids.Close()
+}
+
+// Get the items of a page of a list, for loaders fetching whole lists
+func Paginate[T any](items []T, page Page) []T {
+	if page.Offset >= len(items) {
+		return []T{}
+	}
+	items = items[page.Offset:]
+	if page.Limit > 0 && page.Limit < len(items) {
+		items = items[:page.Limit]
+	}
+	return items
+}
+
+// get the tag identifying the ID lists of a parent
+func listParentTag[TParent any](parent TParent) string {
+	return fmt.Sprintf("%s%v", ListParentTagPrefix, parent)
+}
+
+// Create a new list store
+func NewList[TParent comparable, TID comparable, TValue any](config ListConfig[TParent, TID, TValue]) (*ListStore[TParent, TID, TValue], error) {
+	idsConfig := config.Config
+	layers := make([]Layer[ListKey[TParent], []TID], len(idsConfig.Layers), len(idsConfig.Layers)+1)
+	copy(layers, idsConfig.Layers)
+	idsConfig.Layers = append(layers, funcLayer[ListKey[TParent], []TID]{identifier: "list", load: config.Load})
+
+	// tag the ID lists with their parents so every page of a parent can be evicted
+	tags := idsConfig.Tags
+	idsConfig.Tags = func(key ListKey[TParent], ids []TID) []string {
+		listTags := []string{listParentTag(key.Parent)}
+		if tags != nil {
+			listTags = append(listTags, tags(key, ids)...)
+		}
+		return listTags
+	}
+
+	ids, err := New(idsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &ListStore[TParent, TID, TValue]{
+		ids:      ids,
+		entities: config.Entities,
+	}, nil
+}
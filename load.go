@@ -1,25 +1,131 @@
 package lapis
 
-import "context"
+import (
+	"context"
+	"sync"
+)
+
+// Result of loading a single key
+type Result[TKey comparable, TValue any] struct {
+	Key   TKey
+	Value TValue
+	Err   error
+}
 
 // Load a data from it's key
-func (r *Store[TKey, TValue]) Load(key TKey, flags ...LoadFlag) (TValue, error) {
-	if !r.useBatcher || hasLoadFlag(r.defaultLoadFlags, flags, LoadNoBatch) {
-		return singlify(r.resolveAndCollect)(key)
+func (r *Store[TKey, TValue]) Load(key TKey, options ...LoadOption) (TValue, error) {
+	o := r.loadOptions(options)
+	if !r.useBatcher || o.has(LoadNoBatch) {
+		return singlify(func(keys []TKey) ([]TValue, []error) {
+			return r.resolveAndCollect(keys, o)
+		})(key)
 	}
-	return r.batcher.Load(key)
+	return r.batcher.loadFuture(key, o).Get()
 }
 
-// Load a data by key with a context, if the context is cancelled, the data loading will be cancelled too if
-// this is the only operation
-func (r *Store[TKey, TValue]) LoadCtx(ctx context.Context, key TKey, flags ...[]int) (TValue, error) {
-	panic("not implemented")
+// Load a data by key with a context, if the context is cancelled before the data is loaded, the context error
+// will be returned. The load operation itself is not cancelled since it may be shared with other callers.
+func (r *Store[TKey, TValue]) LoadCtx(ctx context.Context, key TKey, options ...LoadOption) (TValue, error) {
+	return r.LoadFuture(key, options...).GetCtx(ctx)
 }
 
 // Load a set of data from their keys
-func (r *Store[TKey, TValue]) LoadAll(keys []TKey, flags ...LoadFlag) ([]TValue, []error) {
-	if !r.useBatcher || hasLoadFlag(r.defaultLoadFlags, flags, LoadNoBatch) {
-		return r.resolveAndCollect(keys)
+func (r *Store[TKey, TValue]) LoadAll(keys []TKey, options ...LoadOption) ([]TValue, []error) {
+	o := r.loadOptions(options)
+	if !r.useBatcher || o.has(LoadNoBatch) {
+		return r.resolveAndCollect(keys, o)
+	}
+	return r.batcher.loadAllFuture(keys, o).Get()
+}
+
+// Load a set of data by keys with a context, keys that are not loaded before the context is cancelled will
+// have the context error
+func (r *Store[TKey, TValue]) LoadAllCtx(ctx context.Context, keys []TKey, options ...LoadOption) ([]TValue, []error) {
+	return r.LoadAllFuture(keys, options...).GetCtx(ctx)
+}
+
+// Load a set of data from their keys into maps of values and errors keyed by the data keys, duplicate keys are only loaded once
+func (r *Store[TKey, TValue]) LoadMap(keys []TKey, options ...LoadOption) (map[TKey]TValue, map[TKey]error) {
+	uniqueKeys := dedupe(keys)
+	values, errors := r.LoadAll(uniqueKeys, options...)
+	valueMap := make(map[TKey]TValue, len(uniqueKeys))
+	errorMap := make(map[TKey]error)
+	for i, key := range uniqueKeys {
+		if errors[i] != nil {
+			errorMap[key] = errors[i]
+		} else {
+			valueMap[key] = values[i]
+		}
+	}
+	return valueMap, errorMap
+}
+
+// Load a set of data from their keys, each result is sent to the returned channel as soon as its key is resolved
+// Duplicate keys are only loaded once, the channel is closed after all keys are resolved. The channel is buffered
+// so the load will still be finished if the channel is not drained.
+func (r *Store[TKey, TValue]) LoadStream(keys []TKey, options ...LoadOption) <-chan Result[TKey, TValue] {
+	uniqueKeys := dedupe(keys)
+	results := make(chan Result[TKey, TValue], len(uniqueKeys))
+	o := r.loadOptions(options)
+	if !r.useBatcher || o.has(LoadNoBatch) {
+		go func() {
+			r.resolve(uniqueKeys, o, func(index int, value TValue, err error) {
+				results <- Result[TKey, TValue]{Key: uniqueKeys[index], Value: value, Err: err}
+			})
+			close(results)
+		}()
+		return results
+	}
+
+	futures := r.batcher.loadAllFuture(uniqueKeys, o)
+	wg := sync.WaitGroup{}
+	wg.Add(len(futures))
+	for i := range futures {
+		capturedIndex := i
+		go func() {
+			defer wg.Done()
+			value, err := futures[capturedIndex].Get()
+			results <- Result[TKey, TValue]{Key: uniqueKeys[capturedIndex], Value: value, Err: err}
+		}()
 	}
-	return r.batcher.LoadAll(keys)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Start loading a data from it's key and return the pending result without blocking
+// This method should be used if you want one goroutine to make requests to many
+// different stores without blocking until the result is needed, see Wait.
+func (r *Store[TKey, TValue]) LoadFuture(key TKey, options ...LoadOption) *Future[TValue] {
+	o := r.loadOptions(options)
+	if !r.useBatcher || o.has(LoadNoBatch) {
+		return r.resolveFutures([]TKey{key}, o)[0]
+	}
+	return r.batcher.loadFuture(key, o)
+}
+
+// Start loading a set of data from their keys and return the pending results without blocking
+func (r *Store[TKey, TValue]) LoadAllFuture(keys []TKey, options ...LoadOption) Futures[TValue] {
+	o := r.loadOptions(options)
+	if !r.useBatcher || o.has(LoadNoBatch) {
+		return r.resolveFutures(keys, o)
+	}
+	return r.batcher.loadAllFuture(keys, o)
+}
+
+// LoadThunk returns a function that when called will block until the requested data is resolved
+func (r *Store[TKey, TValue]) LoadThunk(key TKey, options ...LoadOption) func() (TValue, error) {
+	return r.LoadFuture(key, options...).Get
+}
+
+// LoadAllThunk returns a function that when called will block until all of the requested data is resolved
+func (r *Store[TKey, TValue]) LoadAllThunk(keys []TKey, options ...LoadOption) func() ([]TValue, []error) {
+	return r.LoadAllFuture(keys, options...).Get
+}
+
+// combine the store default load flags with the given load options
+func (r *Store[TKey, TValue]) loadOptions(options []LoadOption) loadOptions {
+	return newLoadOptions(r.defaultLoadFlags, r.layerIdentifiers, options)
 }
@@ -1,18 +1,103 @@
 package lapis
 
+import "time"
+
 type LoadFlag int
 
 const (
 	LoadNoBatch        LoadFlag = 1 << iota // Don't use the batcher when loading
 	LoadNoCollectBatch                      // Don't use collector on the batcher
 	LoadNoShareBatch                        // Don't use an existing ongoing batch
+	LoadRefresh                             // Skip all cache layers, load from the final layer and prime the cache layers with the result
+	LoadCacheOnly                           // Only load from the cache layers, keys missing from the caches won't be loaded from the final layer
 )
 
-// check if the given flags is enabled
-func hasLoadFlag(def LoadFlag, flags []LoadFlag, flag LoadFlag) bool {
-	sum := def
-	for _, f := range flags {
-		sum = sum | f
+// LoadOption changes the behaviour of a single load call, all load flags are load options
+type LoadOption interface {
+	applyLoadOption(o *loadOptions, identifiers []string)
+}
+
+func (f LoadFlag) applyLoadOption(o *loadOptions, identifiers []string) {
+	o.flags = o.flags | f
+}
+
+type loadOptionFunc func(o *loadOptions, identifiers []string)
+
+func (f loadOptionFunc) applyLoadOption(o *loadOptions, identifiers []string) {
+	f(o, identifiers)
+}
+
+// Skip loading from the first n layers of the store, the skipped layers will still be primed with the loaded data
+// Only the first 64 layers of a store can be skipped
+func LoadSkipLayers(n int) LoadOption {
+	return loadOptionFunc(func(o *loadOptions, identifiers []string) {
+		for i := 0; i < n && i < 64; i++ {
+			o.skip = o.skip | (1 << i)
+		}
+	})
+}
+
+// Skip loading from the layers with the given identifiers, the skipped layers will still be primed with the loaded data
+// Only the first 64 layers of a store can be skipped
+func LoadSkipLayer(layerIdentifiers ...string) LoadOption {
+	return loadOptionFunc(func(o *loadOptions, identifiers []string) {
+		for i, identifier := range identifiers {
+			if i >= 64 {
+				break
+			}
+			for _, skipped := range layerIdentifiers {
+				if identifier == skipped {
+					o.skip = o.skip | (1 << i)
+				}
+			}
+		}
+	})
+}
+
+// Set the maximum acceptable age of cached values. Cached values older than the given duration are treated as
+// missing and will be loaded from the next layers. Cache layers that are not able to report the age of their values
+// (layers not implementing AgeLayer) are skipped.
+// Cache layers are read with GetWithTime instead of GetLeased, so loads with a max age don't get leases and every
+// loader missing a key loads it from the next layers.
+func LoadMaxAge(maxAge time.Duration) LoadOption {
+	return loadOptionFunc(func(o *loadOptions, identifiers []string) {
+		o.maxAge = maxAge
+	})
+}
+
+// options for a single load call, loads with equal options can be batched together
+type loadOptions struct {
+	flags  LoadFlag
+	skip   uint64        // bitmask of the layer indexes to skip
+	maxAge time.Duration // maximum acceptable age of cached values, 0 = no limit
+}
+
+// combine the default load flags and the given load options
+// Loads without options don't allocate, the options escape to the heap once they are passed to a load option
+func newLoadOptions(def LoadFlag, identifiers []string, options []LoadOption) loadOptions {
+	if len(options) == 0 {
+		return loadOptions{flags: def}
+	}
+	o := &loadOptions{flags: def}
+	for _, option := range options {
+		option.applyLoadOption(o, identifiers)
+	}
+	return *o
+}
+
+// check if the given flag is enabled
+func (o loadOptions) has(flag LoadFlag) bool {
+	return (o.flags & flag) == flag
+}
+
+// check if the layer with the given index should not be loaded from
+func (o loadOptions) skips(layerIndex int, layerCount int) bool {
+	isFinalLayer := layerIndex == layerCount-1
+	if o.has(LoadRefresh) && !isFinalLayer {
+		return true
+	}
+	if o.has(LoadCacheOnly) && isFinalLayer {
+		return true
 	}
-	return (sum & flag) == flag
+	return layerIndex < 64 && (o.skip&(1<<layerIndex)) != 0
 }
@@ -1,9 +1,21 @@
 package lapis_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -11,6 +23,8 @@ import (
 	"github.com/flowscan/lapis"
 	"github.com/flowscan/lapis/extension"
 	"github.com/flowscan/lapis/layer"
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
 )
 
 // create a simple int -> int store with 2 layers, a in-memory cache and a backend that squares integers with 100ms delay
@@ -147,3 +161,783 @@ func isPrime(x int) bool {
 	}
 	return true
 }
+
+// a backend that counts the number of keys it has loaded, values are the keys multiplied by the multiplier
+type CountingBackend struct {
+	fakeDelay  time.Duration
+	multiplier int32
+	count      int32
+}
+
+func (s *CountingBackend) Identifier() string {
+	return "CountingBackend"
+}
+
+func (s *CountingBackend) Get(keys []int) ([]int, []error) {
+	time.Sleep(s.fakeDelay)
+	atomic.AddInt32(&s.count, int32(len(keys)))
+	result := make([]int, len(keys))
+	multiplier := atomic.LoadInt32(&s.multiplier)
+	for i, key := range keys {
+		result[i] = int(multiplier) * key
+	}
+	return result, nil
+}
+
+func (s *CountingBackend) Set(keys []int, values []int) []error {
+	return nil
+}
+
+func (s *CountingBackend) SetMultiplier(value int32) {
+	atomic.StoreInt32(&s.multiplier, value)
+}
+
+func (s *CountingBackend) Count() int {
+	return int(atomic.LoadInt32(&s.count))
+}
+
+// a counting backend that can evict by tag but can't store values with tags
+type TagOnlyBackend struct {
+	CountingBackend
+}
+
+func (s *TagOnlyBackend) InvalidateTags(tags []string) error {
+	return nil
+}
+
+// an extension that records the wait duration of dispatched batches
+type BatchRecorder struct {
+	mu    sync.Mutex
+	sizes []int
+	waits []time.Duration
+}
+
+func (e *BatchRecorder) Name() string { return "BatchRecorder" }
+
+func (e *BatchRecorder) BatchDispatchHook(keys []int, wait time.Duration) {
+	e.mu.Lock()
+	e.sizes = append(e.sizes, len(keys))
+	e.waits = append(e.waits, wait)
+	e.mu.Unlock()
+}
+
+func (e *BatchRecorder) Last() (int, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sizes[len(e.sizes)-1], e.waits[len(e.waits)-1]
+}
+
+// a backend that tracks the maximum number of concurrent loads
+type ConcurrencyTrackingBackend struct {
+	fakeDelay time.Duration
+	current   int32
+	max       int32
+}
+
+func (s *ConcurrencyTrackingBackend) Identifier() string { return "ConcurrencyTrackingBackend" }
+
+func (s *ConcurrencyTrackingBackend) Get(keys []int) ([]int, []error) {
+	current := atomic.AddInt32(&s.current, 1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if current <= max || atomic.CompareAndSwapInt32(&s.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(s.fakeDelay)
+	atomic.AddInt32(&s.current, -1)
+	return keys, nil
+}
+
+func (s *ConcurrencyTrackingBackend) Set(keys []int, values []int) []error {
+	return nil
+}
+
+// a layer that panics when loading or setting the key 13
+type PanickingLayer struct{}
+
+func (s PanickingLayer) Identifier() string { return "PanickingLayer" }
+
+func (s PanickingLayer) Get(keys []int) ([]int, []error) {
+	for _, key := range keys {
+		if key == 13 {
+			panic("unlucky get")
+		}
+	}
+	return keys, nil
+}
+
+func (s PanickingLayer) Set(keys []int, values []int) []error {
+	for _, key := range keys {
+		if key == 13 {
+			panic("unlucky set")
+		}
+	}
+	return nil
+}
+
+// a layer returning fewer values than the requested keys
+type MalformedLayer struct{}
+
+func (s MalformedLayer) Identifier() string { return "MalformedLayer" }
+
+func (s MalformedLayer) Get(keys []int) ([]int, []error) {
+	return keys[:len(keys)-1], nil
+}
+
+func (s MalformedLayer) Set(keys []int, values []int) []error {
+	return nil
+}
+
+// a panic hook extension recording recovered panics
+type PanicRecorder struct {
+	mu     sync.Mutex
+	panics []lapis.ErrLayerPanic
+}
+
+func (e *PanicRecorder) Name() string { return "PanicRecorder" }
+
+func (e *PanicRecorder) PanicHook(traceID uint64, err lapis.ErrLayerPanic) {
+	e.mu.Lock()
+	e.panics = append(e.panics, err)
+	e.mu.Unlock()
+}
+
+func (e *PanicRecorder) Count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.panics)
+}
+
+// an extension that panics before loading from a layer and records recovered panics
+type PanickingExtension struct {
+	mu     sync.Mutex
+	panics []lapis.ErrLayerPanic
+}
+
+func (e *PanickingExtension) Name() string { return "PanickingExtension" }
+
+func (e *PanickingExtension) LayerPreLoadHook(traceID uint64, layerIndex int, keys []int) []error {
+	panic("unlucky hook")
+}
+
+func (e *PanickingExtension) PanicHook(traceID uint64, err lapis.ErrLayerPanic) {
+	e.mu.Lock()
+	e.panics = append(e.panics, err)
+	e.mu.Unlock()
+}
+
+func (e *PanickingExtension) Panics() []lapis.ErrLayerPanic {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]lapis.ErrLayerPanic{}, e.panics...)
+}
+
+// a backend that accepts writes, writes of negative keys are rejected and the first few writes fail temporarily
+type WritableBackend struct {
+	mu       sync.Mutex
+	data     map[int]int
+	writes   int
+	failures int
+}
+
+func (s *WritableBackend) Identifier() string { return "WritableBackend" }
+
+func (s *WritableBackend) Get(keys []int) ([]int, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]int, len(keys))
+	errors := make([]error, len(keys))
+	for i, key := range keys {
+		if value, ok := s.data[key]; ok {
+			result[i] = value
+		} else {
+			errors[i] = lapis.NewErrNotFound(key)
+		}
+	}
+	return result, errors
+}
+
+func (s *WritableBackend) Set(keys []int, values []int) []error {
+	return nil
+}
+
+func (s *WritableBackend) Write(keys []int, values []int) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	errors := make([]error, len(keys))
+	for i, key := range keys {
+		if key < 0 {
+			errors[i] = fmt.Errorf("rejected key %d", key)
+			continue
+		}
+		if s.failures > 0 {
+			s.failures--
+			errors[i] = fmt.Errorf("temporary failure")
+			continue
+		}
+		s.data[key] = values[i]
+	}
+	return errors
+}
+
+func (s *WritableBackend) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// a database/sql driver serving rows of (id, name) from a map, recording the executed queries
+// The placeholders of the queries are checked against the arguments, ? and $n placeholders are bound to single ids
+// and an array argument formatted as {1,2,3} holds several ids
+type FakeSQLDriver struct {
+	mu      sync.Mutex
+	rows    map[int64]string
+	queries []FakeSQLQuery
+}
+
+// a query executed by the fake SQL driver
+type FakeSQLQuery struct {
+	Query string
+	Args  []driver.Value
+}
+
+func (d *FakeSQLDriver) Connect(ctx context.Context) (driver.Conn, error) { return fakeSQLConn{d}, nil }
+
+func (d *FakeSQLDriver) Driver() driver.Driver { return nil }
+
+func (d *FakeSQLDriver) Queries() []FakeSQLQuery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queries := d.queries
+	d.queries = nil
+	return queries
+}
+
+// check that every argument is bound to a placeholder of a single style
+func checkSQLPlaceholders(query string, args []driver.Value) error {
+	questions := strings.Count(query, "?")
+	dollars := regexp.MustCompile(`\$(\d+)`).FindAllStringSubmatch(query, -1)
+	if questions > 0 && len(dollars) > 0 {
+		return fmt.Errorf("mixed placeholders in %q", query)
+	}
+	if len(dollars) == 0 {
+		if questions != len(args) {
+			return fmt.Errorf("%d placeholders for %d arguments in %q", questions, len(args), query)
+		}
+		return nil
+	}
+	bound := make([]bool, len(args))
+	for _, dollar := range dollars {
+		index, _ := strconv.Atoi(dollar[1])
+		if index < 1 || index > len(args) {
+			return fmt.Errorf("placeholder $%d out of range in %q", index, query)
+		}
+		bound[index-1] = true
+	}
+	for i, ok := range bound {
+		if !ok {
+			return fmt.Errorf("argument %d is not bound in %q", i+1, query)
+		}
+	}
+	return nil
+}
+
+type fakeSQLConn struct {
+	driver *FakeSQLDriver
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{driver: c.driver, query: query}, nil
+}
+
+func (c fakeSQLConn) Close() error { return nil }
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+type fakeSQLStmt struct {
+	driver *FakeSQLDriver
+	query  string
+}
+
+func (s fakeSQLStmt) Close() error { return nil }
+
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("exec is not supported")
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := checkSQLPlaceholders(s.query, args); err != nil {
+		return nil, err
+	}
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	s.driver.queries = append(s.driver.queries, FakeSQLQuery{Query: s.query, Args: args})
+	var ids []int64
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case int64:
+			ids = append(ids, arg)
+		case string:
+			for _, id := range strings.Split(strings.Trim(arg, "{}"), ",") {
+				parsed, err := strconv.ParseInt(id, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				ids = append(ids, parsed)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported argument %T", arg)
+		}
+	}
+	rows := &fakeSQLRows{}
+	for _, id := range ids {
+		if name, ok := s.driver.rows[id]; ok {
+			rows.values = append(rows.values, []driver.Value{id, name})
+		}
+	}
+	return rows, nil
+}
+
+// an array of ids passed as a single parameter, formatted like a PostgreSQL array
+type FakeSQLArray []int
+
+func (a FakeSQLArray) Value() (driver.Value, error) {
+	ids := make([]string, len(a))
+	for i, id := range a {
+		ids[i] = strconv.Itoa(id)
+	}
+	return "{" + strings.Join(ids, ",") + "}", nil
+}
+
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"id", "name"} }
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// an in-process memcached server supporting the get and set commands of the text protocol
+type FakeMemcached struct {
+	listener     net.Listener
+	mu           sync.Mutex
+	data         map[string][]byte
+	expirations  map[string]int64
+	maxValueSize int // values larger than this are rejected like memcached does, 0 = no limit
+}
+
+func NewFakeMemcached(t *testing.T) *FakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &FakeMemcached{listener: listener, data: make(map[string][]byte), expirations: make(map[string]int64)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *FakeMemcached) Address() string { return m.listener.Addr().String() }
+
+func (m *FakeMemcached) Expiration(key string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expirations[key]
+}
+
+func (m *FakeMemcached) SetMaxValueSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxValueSize = size
+}
+
+func (m *FakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		response := bytes.Buffer{}
+		switch fields[0] {
+		case "get":
+			m.mu.Lock()
+			for _, key := range fields[1:] {
+				if value, ok := m.data[key]; ok {
+					fmt.Fprintf(&response, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+				}
+			}
+			m.mu.Unlock()
+			response.WriteString("END\r\n")
+		case "set":
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, value); err != nil {
+				return
+			}
+			expiration, _ := strconv.ParseInt(fields[3], 10, 64)
+			m.mu.Lock()
+			if m.maxValueSize > 0 && size > m.maxValueSize {
+				response.WriteString("SERVER_ERROR object too large for cache\r\n")
+			} else {
+				m.data[fields[1]] = value[:size]
+				m.expirations[fields[1]] = expiration
+				response.WriteString("STORED\r\n")
+			}
+			m.mu.Unlock()
+		default:
+			response.WriteString("ERROR\r\n")
+		}
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// a redis pool backed by a stub supporting the hash commands used by the redis hash layer
+func newFakeRedisHashPool(t *testing.T) *radix.Pool {
+	var mu sync.Mutex
+	hashes := make(map[string]map[string]string)
+	stub := func(args []string) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "HGETALL":
+			result := []string{}
+			for field, value := range hashes[args[1]] {
+				result = append(result, field, value)
+			}
+			return result
+		case "EVALSHA":
+			return resp2.Error{E: errors.New("NOSCRIPT stub does not cache scripts")}
+		case "EVAL":
+			// the set script has the retention followed by pairs of fields, the set fields script has the nil field
+			// followed by the pairs
+			key, arguments := args[3], args[4:]
+			if arguments[0] == layer.RedisNilValue {
+				hash, ok := hashes[key]
+				if _, isNil := hash[layer.RedisNilValue]; !ok || isNil {
+					return 0
+				}
+			} else {
+				hashes[key] = make(map[string]string)
+			}
+			arguments = arguments[1:]
+			for i := 0; i < len(arguments); i += 2 {
+				hashes[key][arguments[i]] = arguments[i+1]
+			}
+			return 1
+		}
+		return resp2.Error{E: fmt.Errorf("unsupported command %s", args[0])}
+	}
+	pool, err := radix.NewPool("tcp", "stub", 1, radix.PoolConnFunc(func(network, addr string) (radix.Conn, error) {
+		return radix.Stub(network, addr, stub), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// create a radix pool backed by a stub emulating the commands and scripts used by the redis layer
+// scripts are told apart by their content, the stub does not cache scripts so radix falls back to EVAL
+func newFakeRedisPool(t *testing.T) *radix.Pool {
+	var mu sync.Mutex
+	values := make(map[string]string)
+	sets := make(map[string]map[string]bool)
+	stub := func(args []string) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "MGET":
+			result := make([]interface{}, len(args)-1)
+			for i, key := range args[1:] {
+				if value, ok := values[key]; ok {
+					result[i] = value
+				}
+			}
+			return result
+		case "MSET":
+			for i := 1; i+1 < len(args); i += 2 {
+				values[args[i]] = args[i+1]
+			}
+			return "OK"
+		case "DEL":
+			for _, key := range args[1:] {
+				delete(values, key)
+				delete(sets, key)
+			}
+			return len(args) - 1
+		case "SCAN":
+			// a single page of the keys matching a prefix pattern
+			prefix := strings.TrimSuffix(args[3], "*")
+			keys := []string{}
+			for key := range values {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, key)
+				}
+			}
+			for key := range sets {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			return []interface{}{"0", keys}
+		case "EVALSHA":
+			return resp2.Error{E: errors.New("NOSCRIPT stub does not cache scripts")}
+		case "EVAL":
+			script := args[1]
+			keyCount, _ := strconv.Atoi(args[2])
+			keys, arguments := args[3:3+keyCount], args[3+keyCount:]
+			switch {
+			case strings.Contains(script, "newer("):
+				// set entries: triples of value, version, and lease keys
+				results := make([]int, 0, len(keys)/3)
+				cursor := 1
+				for i := 0; i < len(keys); i += 3 {
+					value, version, lease := arguments[cursor], arguments[cursor+1], arguments[cursor+2]
+					tagCount, _ := strconv.Atoi(arguments[cursor+3])
+					tags := arguments[cursor+4 : cursor+4+tagCount]
+					cursor += 4 + tagCount
+					current, versioned := values[keys[i+1]]
+					newVersion, _ := strconv.ParseInt(version, 10, 64)
+					currentVersion, _ := strconv.ParseInt(current, 10, 64)
+					if lease != "0" && values[keys[i+2]] != lease {
+						results = append(results, 2)
+					} else if version == "0" || !versioned || newVersion > currentVersion {
+						values[keys[i]] = value
+						if version != "0" {
+							values[keys[i+1]] = version
+						}
+						delete(values, keys[i+2])
+						for _, tag := range tags {
+							if sets[tag] == nil {
+								sets[tag] = make(map[string]bool)
+							}
+							sets[tag][keys[i]] = true
+						}
+						results = append(results, 1)
+					} else {
+						results = append(results, 0)
+					}
+				}
+				return results
+			case strings.Contains(script, "'NX'"):
+				// get leased: pairs of value and lease keys, a lease is only issued if none is held
+				results := make([]string, 0, len(keys))
+				for i := 0; i < len(keys); i += 2 {
+					if value, ok := values[keys[i]]; ok {
+						results = append(results, value, "")
+					} else if _, ok := values[keys[i+1]]; !ok {
+						values[keys[i+1]] = arguments[i/2+1]
+						results = append(results, "", arguments[i/2+1])
+					} else {
+						results = append(results, "", "-")
+					}
+				}
+				return results
+			case strings.Contains(script, "SMEMBERS"):
+				// invalidate tags: delete the members of the tag sets with their metadata keys, then the tag sets
+				for _, tagKey := range keys {
+					for key := range sets[tagKey] {
+						delete(values, key)
+						delete(values, key+arguments[0])
+						delete(values, key+arguments[1])
+					}
+					delete(sets, tagKey)
+				}
+				return 0
+			}
+		}
+		return resp2.Error{E: fmt.Errorf("unsupported command %s", args[0])}
+	}
+	pool, err := radix.NewPool("tcp", "stub", 1, radix.PoolConnFunc(func(network, addr string) (radix.Conn, error) {
+		return radix.Stub(network, addr, stub), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// FailingLayer wraps a layer and fails every call while it is down
+type FailingLayer struct {
+	lapis.Layer[int, int]
+	down  int32
+	calls int32
+}
+
+var errReplicaDown = errors.New("replica is down")
+
+func (s *FailingLayer) Get(keys []int) ([]int, []error) {
+	atomic.AddInt32(&s.calls, 1)
+	if atomic.LoadInt32(&s.down) == 1 {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = errReplicaDown
+		}
+		return make([]int, len(keys)), errs
+	}
+	return s.Layer.Get(keys)
+}
+
+func (s *FailingLayer) Set(keys []int, values []int) []error {
+	if atomic.LoadInt32(&s.down) == 1 {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = errReplicaDown
+		}
+		return errs
+	}
+	return s.Layer.Set(keys, values)
+}
+
+func (s *FailingLayer) SetDown(down bool) {
+	if down {
+		atomic.StoreInt32(&s.down, 1)
+	} else {
+		atomic.StoreInt32(&s.down, 0)
+	}
+}
+
+func (s *FailingLayer) Calls() int {
+	return int(atomic.LoadInt32(&s.calls))
+}
+
+// create a pool of fake redis connections supporting the bitmap commands and scripts of the redis bloom filter
+// scripts are told apart by their content, the stub does not cache scripts so radix falls back to EVAL
+// expiration is not emulated
+func newFakeRedisBitmapPool(t *testing.T) *radix.Pool {
+	var mu sync.Mutex
+	bitmaps := make(map[string]map[string]bool)
+	sets := make(map[string]map[string]bool)
+	setBit := func(key, position string) {
+		if bitmaps[key] == nil {
+			bitmaps[key] = make(map[string]bool)
+		}
+		bitmaps[key][position] = true
+	}
+	stub := func(args []string) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "SETBIT":
+			setBit(args[1], args[2])
+			return 0
+		case "BITFIELD":
+			result := []int{}
+			for i := 2; i+2 < len(args); i += 3 {
+				if bitmaps[args[1]][args[i+2]] {
+					result = append(result, 1)
+				} else {
+					result = append(result, 0)
+				}
+			}
+			return result
+		case "PEXPIRE":
+			if bitmaps[args[1]] == nil {
+				return 0
+			}
+			return 1
+		case "SADD":
+			if sets[args[1]] == nil {
+				sets[args[1]] = make(map[string]bool)
+			}
+			sets[args[1]][args[2]] = true
+			return 1
+		case "SREM":
+			delete(sets[args[1]], args[2])
+			return 1
+		case "DEL":
+			delete(bitmaps, args[1])
+			return 1
+		case "EVALSHA":
+			return resp2.Error{E: errors.New("NOSCRIPT stub does not cache scripts")}
+		case "EVAL":
+			script, count := args[1], 0
+			fmt.Sscan(args[2], &count)
+			keys, arguments := args[3:3+count], args[3+count:]
+			switch {
+			case strings.Contains(script, "RENAME"):
+				if !sets[keys[1]][keys[2]] || bitmaps[keys[2]] == nil {
+					return 0
+				}
+				delete(sets[keys[1]], keys[2])
+				bitmaps[keys[0]] = bitmaps[keys[2]]
+				delete(bitmaps, keys[2])
+				return 1
+			case strings.Contains(script, "SMEMBERS"):
+				for build := range sets[keys[1]] {
+					if bitmaps[build] == nil {
+						delete(sets[keys[1]], build)
+					}
+				}
+				for _, position := range arguments {
+					setBit(keys[0], position)
+					for build := range sets[keys[1]] {
+						setBit(build, position)
+					}
+				}
+				return 1
+			}
+		}
+		return resp2.Error{E: fmt.Errorf("unsupported command %s", args[0])}
+	}
+	pool, err := radix.NewPool("tcp", "stub", 1, radix.PoolConnFunc(func(network, addr string) (radix.Conn, error) {
+		return radix.Stub(network, addr, stub), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// a backend loading every key with a function
+type FuncBackend[TKey comparable, TValue any] struct {
+	load func(key TKey) TValue
+}
+
+func (s FuncBackend[TKey, TValue]) Identifier() string {
+	return "FuncBackend"
+}
+
+func (s FuncBackend[TKey, TValue]) Get(keys []TKey) ([]TValue, []error) {
+	result := make([]TValue, len(keys))
+	for i, key := range keys {
+		result[i] = s.load(key)
+	}
+	return result, nil
+}
+
+func (s FuncBackend[TKey, TValue]) Set(keys []TKey, values []TValue) []error {
+	return nil
+}
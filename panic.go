@@ -0,0 +1,100 @@
+package lapis
+
+import (
+	"runtime/debug"
+)
+
+// convert a recovered panic into an error and notify the panic hooks
+// layer is the identifier of the panicking layer, extension is the name of the panicking extension
+func (r *Store[TKey, TValue]) recovered(traceID uint64, value any, layer string, extension string) ErrLayerPanic {
+	err := ErrLayerPanic{
+		Layer:     layer,
+		Extension: extension,
+		Value:     value,
+		Stack:     debug.Stack(),
+	}
+	for _, hook := range r.panicHooks {
+		notifyPanic(hook, traceID, err)
+	}
+	return err
+}
+
+// notify a panic hook, panics inside the panic hook itself are ignored
+func notifyPanic[TKey comparable, TValue any](hook PanicHookExtension[TKey, TValue], traceID uint64, err ErrLayerPanic) {
+	defer func() {
+		recover()
+	}()
+	hook.PanicHook(traceID, err)
+}
+
+// execute an extension hook, recovering from panics
+// returns an ErrLayerPanic if the hook panicked
+func (r *Store[TKey, TValue]) runHook(traceID uint64, hook any, fn func()) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			var name string
+			if ext, ok := hook.(Extension); ok {
+				name = ext.Name()
+			}
+			err = r.recovered(traceID, v, "", name)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// load values from a layer, a panic in the layer fails all of the given keys
+// leases are returned for layers issuing leases
+func (r *Store[TKey, TValue]) layerGet(traceID uint64, layerIndex int, keys []TKey, options loadOptions) (values []TValue, leases []Lease, errors []error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := r.recovered(traceID, v, r.layerIdentifiers[layerIndex], "")
+			values = make([]TValue, len(keys))
+			leases = nil
+			errors = fillErrors(len(keys), err)
+		}
+	}()
+	layer := r.layers[layerIndex]
+	if options.maxAge > 0 && layerIndex < len(r.layers)-1 {
+		values, errors = getFresh(layer.(AgeLayer[TKey, TValue]), keys, options.maxAge)
+		return values, nil, errors
+	}
+	if leaseLayer, ok := layer.(LeaseLayer[TKey, TValue]); ok {
+		return r.getLeased(leaseLayer, keys)
+	}
+	values, errors = layer.Get(keys)
+	return values, nil, errors
+}
+
+// set values into a layer, a panic in the layer fails all of the given keys
+// values are written to the final layer instead if a write mode is configured
+func (r *Store[TKey, TValue]) layerSetValues(traceID uint64, layerIndex int, keys []TKey, values []TValue, leases []Lease) (errors []error) {
+	defer func() {
+		if v := recover(); v != nil {
+			errors = fillErrors(len(keys), r.recovered(traceID, v, r.layerIdentifiers[layerIndex], ""))
+		}
+	}()
+	if r.writer != nil && layerIndex == len(r.layers)-1 {
+		return r.writer.Write(keys, values)
+	}
+	return r.setLayer(r.layers[layerIndex], keys, values, leases)
+}
+
+// create an array of errors filled with the given error
+func fillErrors(count int, err error) []error {
+	errors := make([]error, count)
+	for i := range errors {
+		errors[i] = err
+	}
+	return errors
+}
+
+// evict tagged values from a layer, recovering from panics in the layer
+func (r *Store[TKey, TValue]) layerInvalidateTags(traceID uint64, layerIndex int, layer TagLayer, tags []string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = r.recovered(traceID, v, r.layerIdentifiers[layerIndex], "")
+		}
+	}()
+	return layer.InvalidateTags(tags)
+}
@@ -0,0 +1,190 @@
+package lapis
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Indicates that the final layer of a query store was asked for a key whose query is not being loaded, such as when
+// the store is warmed with canonical keys
+var ErrUnknownQuery = errors.New("lapis: the query of the key is not being loaded")
+
+// Configuration for a query store
+type QueryConfig[TQuery any, TKey comparable, TValue any] struct {
+	// Configuration of the store of the canonical keys, the layers cache the values by the canonical keys and Load is
+	// added as the final layer
+	Config[TKey, TValue]
+
+	// Map a query to its canonical key used for batching, deduplication, and the cache layers, equal queries must
+	// have equal keys, see JSONQueryKey
+	Key func(query TQuery) (TKey, error)
+
+	// Load the values of a batch of queries, called with the original queries
+	Load func(queries []TQuery) ([]TValue, []error)
+}
+
+// QueryStore loads values by query objects that can't be used as keys, such as queries containing slices or maps
+type QueryStore[TQuery any, TKey comparable, TValue any] struct {
+	store   *Store[TKey, TValue]
+	key     func(query TQuery) (TKey, error)
+	queries map[TKey]*pendingQuery[TQuery]
+	mu      sync.Mutex
+}
+
+// a query being loaded, shared by the loads of equal queries
+type pendingQuery[TQuery any] struct {
+	query TQuery
+	refs  int
+}
+
+// Load a value by its query
+func (r *QueryStore[TQuery, TKey, TValue]) Load(query TQuery, options ...LoadOption) (TValue, error) {
+	values, errors := r.LoadAll([]TQuery{query}, options...)
+	return values[0], errors[0]
+}
+
+// Load a set of values by their queries, queries failing to be mapped to a key have the mapping error
+func (r *QueryStore[TQuery, TKey, TValue]) LoadAll(queries []TQuery, options ...LoadOption) ([]TValue, []error) {
+	result := make([]TValue, len(queries))
+	errors := make([]error, len(queries))
+	indexes, keys := r.keys(queries, errors)
+	if len(keys) == 0 {
+		return result, errors
+	}
+
+	r.register(queries, indexes, keys)
+	defer r.release(keys)
+	values, loadErrors := r.store.LoadAll(keys, options...)
+	for j, i := range indexes {
+		result[i], errors[i] = values[j], loadErrors[j]
+	}
+	return result, errors
+}
+
+// Set a value of a query into the layers
+// Returns an array of errors with each item represents an error returned by a layer
+func (r *QueryStore[TQuery, TKey, TValue]) Set(query TQuery, value TValue, flags ...SetFlag) []error {
+	key, err := r.key(query)
+	if err != nil {
+		errors := make([]error, len(r.store.layers))
+		for i := range errors {
+			errors[i] = err
+		}
+		return errors
+	}
+	return r.store.Set(key, value, flags...)
+}
+
+// Get the store of the canonical keys, such as to invalidate tags
+func (r *QueryStore[TQuery, TKey, TValue]) Store() *Store[TKey, TValue] {
+	return r.store
+}
+
+// Stop the background goroutines of the store of the canonical keys
+func (r *QueryStore[TQuery, TKey, TValue]) Close() error {
+	return r.store.Close()
+}
+
+// map the queries to their keys, the mapping errors are written to the errors array and indexes map the keys to
+// the given queries
+func (r *QueryStore[TQuery, TKey, TValue]) keys(queries []TQuery, errors []error) ([]int, []TKey) {
+	indexes := make([]int, 0, len(queries))
+	keys := make([]TKey, 0, len(queries))
+	for i, query := range queries {
+		key, err := r.key(query)
+		if err != nil {
+			errors[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		keys = append(keys, key)
+	}
+	return indexes, keys
+}
+
+// register the queries being loaded so the final layer can get them from their keys
+func (r *QueryStore[TQuery, TKey, TValue]) register(queries []TQuery, indexes []int, keys []TKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for j, i := range indexes {
+		pending, ok := r.queries[keys[j]]
+		if !ok {
+			pending = &pendingQuery[TQuery]{query: queries[i]}
+			r.queries[keys[j]] = pending
+		}
+		pending.refs++
+	}
+}
+
+// release the queries once they are loaded
+func (r *QueryStore[TQuery, TKey, TValue]) release(keys []TKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		pending := r.queries[key]
+		pending.refs--
+		if pending.refs == 0 {
+			delete(r.queries, key)
+		}
+	}
+}
+
+// load the values of a batch of keys with the original queries
+func (r *QueryStore[TQuery, TKey, TValue]) loadQueries(load func(queries []TQuery) ([]TValue, []error)) func(keys []TKey) ([]TValue, []error) {
+	return func(keys []TKey) ([]TValue, []error) {
+		result := make([]TValue, len(keys))
+		errors := make([]error, len(keys))
+		indexes := make([]int, 0, len(keys))
+		queries := make([]TQuery, 0, len(keys))
+		r.mu.Lock()
+		for i, key := range keys {
+			pending, ok := r.queries[key]
+			if !ok {
+				errors[i] = ErrUnknownQuery
+				continue
+			}
+			indexes = append(indexes, i)
+			queries = append(queries, pending.query)
+		}
+		r.mu.Unlock()
+		if len(queries) == 0 {
+			return result, errors
+		}
+
+		values, loadErrors := load(queries)
+		for j, i := range indexes {
+			result[i] = values[j]
+			if len(loadErrors) > 0 {
+				errors[i] = loadErrors[j]
+			}
+		}
+		return result, errors
+	}
+}
+
+// JSONQueryKey maps a query to its JSON encoding, which is canonical for structs, slices, and maps since the keys of
+// maps are sorted
+func JSONQueryKey[TQuery any](query TQuery) (string, error) {
+	encoded, err := json.Marshal(query)
+	return string(encoded), err
+}
+
+// Create a new query store
+func NewQuery[TQuery any, TKey comparable, TValue any](config QueryConfig[TQuery, TKey, TValue]) (*QueryStore[TQuery, TKey, TValue], error) {
+	r := &QueryStore[TQuery, TKey, TValue]{
+		key:     config.Key,
+		queries: make(map[TKey]*pendingQuery[TQuery]),
+	}
+	storeConfig := config.Config
+	layers := make([]Layer[TKey, TValue], len(storeConfig.Layers), len(storeConfig.Layers)+1)
+	copy(layers, storeConfig.Layers)
+	storeConfig.Layers = append(layers, funcLayer[TKey, TValue]{identifier: "query", load: r.loadQueries(config.Load)})
+
+	store, err := New(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	r.store = store
+	return r, nil
+}
@@ -1,7 +1,9 @@
 package lapis
 
+import "time"
+
 // Load a set of data from their keys and prime the layers with the data resolved by the next layer
-func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, value TValue, err error)) {
+func (r *Store[TKey, TValue]) resolve(keys []TKey, options loadOptions, finishKey func(index int, value TValue, err error)) {
 	var keysCount = len(keys)
 
 	var errors []error = make([]error, keysCount)
@@ -9,12 +11,41 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 	var layerKeys = keys                                      // set of keys to be resolved by the current layer
 
 	var traceID uint64 = r.getTraceID()
+	var leases resolveLeases                     // leases issued by the layers, used when priming
+	var generations = r.derivedGenerations(keys) // invalidation generations of derived keys, used when priming
+
+	// fail the unfinished keys if resolving panics outside of the layers and hooks, such as on malformed layer
+	// results, so callers are never left blocked
+	finished := make([]bool, keysCount)
+	finish := finishKey
+	finishKey = func(index int, value TValue, err error) {
+		finished[index] = true
+		finish(index, value, err)
+	}
+	currentLayer := -1
+	defer func() {
+		if v := recover(); v != nil {
+			source := r.identifier
+			if currentLayer >= 0 {
+				source = r.layerIdentifiers[currentLayer]
+			}
+			err := r.recovered(traceID, v, source, "")
+			for i := range finished {
+				if !finished[i] {
+					finishKey(i, zero[TValue](), err)
+				}
+			}
+		}
+	}()
 
 	// execute pre-load hooks before execution
 	if len(r.preLoadHooks) > 0 {
 		preLoadErrors := make([]error, keysCount)
 		for _, hook := range r.preLoadHooks {
-			mergeErrors(preLoadErrors, hook.PreLoadHook(traceID, keys))
+			capturedHook := hook
+			r.runHook(traceID, hook, func() {
+				mergeErrors(preLoadErrors, capturedHook.PreLoadHook(traceID, keys))
+			})
 		}
 
 		// filter out the keys that is blocked by the pre-load hooks
@@ -23,23 +54,36 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 
 	// iterate over all data layers from the beginning to the end
 	// if any of the results are empty, try resolving the data from the next layer
-	for layerIndex, layer := range r.layers {
+	for layerIndex := range r.layers {
+
+		// skip the layers excluded by the load options, they will still be primed
+		if r.skipsLayer(layerIndex, options) {
+			continue
+		}
+		currentLayer = layerIndex
 
 		// execute layer pre-load hooks before execution
 		if len(r.layerPreLoadHooks) > 0 {
 			// TODO block execution for error-returning
 			for _, hook := range r.layerPreLoadHooks {
-				hook.LayerPreLoadHook(traceID, layerIndex, layerKeys)
+				capturedHook := hook
+				r.runHook(traceID, hook, func() {
+					capturedHook.LayerPreLoadHook(traceID, layerIndex, layerKeys)
+				})
 			}
 		}
 
-		layerResult, layerErrors := layer.Get(layerKeys)
+		layerResult, layerLeases, layerErrors := r.layerGet(traceID, layerIndex, layerKeys, options)
+		leases.record(len(r.layers), keysCount, layerIndex, unresolvedResultIndexes, layerLeases, layerErrors)
 
 		// execute layer post-load hooks
 		if len(r.layerPostLoadHooks) > 0 {
 			// TODO strip result for error-returning
 			for _, hook := range r.layerPostLoadHooks {
-				hook.LayerPostLoadHook(traceID, layerIndex, layerKeys, layerResult, layerErrors)
+				capturedHook := hook
+				r.runHook(traceID, hook, func() {
+					capturedHook.LayerPostLoadHook(traceID, layerIndex, layerKeys, layerResult, layerErrors)
+				})
 			}
 		}
 
@@ -56,21 +100,8 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 			// prime the data on the previous layers
 			if layerIndex > 0 {
 				for i := layerIndex - 1; i >= 0; i-- {
-					capturedIndex := i
-					go func() {
-						// execute layer pre-set hooks
-						for _, hook := range r.layerPreSetHooks {
-							// TODO strip result for error-returning
-							hook.LayerPreSetHook(traceID, capturedIndex, resolvedLayerKeys, resolvedLayerValues)
-						}
-
-						setErrors := r.layers[capturedIndex].Set(resolvedLayerKeys, resolvedLayerValues)
-
-						// execute layer post-set hooks
-						for _, hook := range r.layerPostSetHooks {
-							hook.LayerPostSetHook(traceID, capturedIndex, resolvedLayerKeys, resolvedLayerValues, setErrors)
-						}
-					}()
+					layerLeases, denied := leases.of(i)
+					go r.prime(traceID, i, layerLeases, denied, generations, resolvedResultIndexes, resolvedLayerKeys, resolvedLayerValues)
 				}
 			}
 
@@ -81,6 +112,13 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 			}
 		}
 
+		// finish the keys known to not exist without loading them from the next layers
+		unresolvedLayerIndexes, unresolvedLayerKeys, unresolvedLayerErrors = finishAuthoritative(unresolvedResultIndexes, unresolvedLayerIndexes, unresolvedLayerKeys, unresolvedLayerErrors, finishKey)
+		if len(unresolvedLayerKeys) == 0 {
+			unresolvedResultIndexes = nil
+			break
+		}
+
 		// merge the errors to the result
 		mergeWithIndexes(errors, unresolvedLayerErrors, unresolvedLayerIndexes)
 
@@ -90,9 +128,14 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 	}
 
 	// call finishKey for all unresolved values
+	// keys that were not loaded from any layer due to the load options are not found
 	if len(unresolvedResultIndexes) > 0 {
 		for i := range unresolvedResultIndexes {
-			finishKey(unresolvedResultIndexes[i], zero[TValue](), errors[unresolvedResultIndexes[i]])
+			resultIndex := unresolvedResultIndexes[i]
+			if errors[resultIndex] == nil {
+				errors[resultIndex] = NewErrNotFound(keys[resultIndex])
+			}
+			finishKey(resultIndex, zero[TValue](), errors[resultIndex])
 		}
 	}
 
@@ -105,10 +148,10 @@ func (r *Store[TKey, TValue]) resolve(keys []TKey, finishKey func(index int, val
 	// }
 }
 
-func (r *Store[TKey, TValue]) resolveAndCollect(keys []TKey) ([]TValue, []error) {
+func (r *Store[TKey, TValue]) resolveAndCollect(keys []TKey, options loadOptions) ([]TValue, []error) {
 	result := make([]TValue, len(keys))
 	errors := make([]error, len(keys))
-	r.resolve(keys, func(index int, value TValue, err error) {
+	r.resolve(keys, options, func(index int, value TValue, err error) {
 		if err != nil {
 			errors[index] = err
 		} else {
@@ -118,6 +161,75 @@ func (r *Store[TKey, TValue]) resolveAndCollect(keys []TKey) ([]TValue, []error)
 	return result, errors
 }
 
+// resolve the keys in the background without the batcher
+func (r *Store[TKey, TValue]) resolveFutures(keys []TKey, options loadOptions) Futures[TValue] {
+	results, futures := newResolveResults[TValue](len(keys))
+	go r.resolve(keys, options, results.finishKey)
+	return futures
+}
+
+// results of an unbatched resolve
+type resolveResults[TValue any] struct {
+	done   []chan struct{}
+	values []TValue
+	errors []error
+}
+
+// create the results of an unbatched operation and their futures
+func newResolveResults[TValue any](count int) (*resolveResults[TValue], Futures[TValue]) {
+	futures := make(Futures[TValue], count)
+	results := &resolveResults[TValue]{
+		done:   make([]chan struct{}, count),
+		values: make([]TValue, count),
+		errors: make([]error, count),
+	}
+	for i := range futures {
+		results.done[i] = make(chan struct{})
+		futures[i] = newFuture[TValue](results.done[i], results, i)
+	}
+	return results, futures
+}
+
+func (r *resolveResults[TValue]) finishKey(index int, value TValue, err error) {
+	r.values[index] = value
+	r.errors[index] = err
+	close(r.done[index])
+}
+
+func (r *resolveResults[TValue]) result(index int) (TValue, error) {
+	return r.values[index], r.errors[index]
+}
+
+// check if the layer with the given index should not be loaded from with the given load options
+func (r *Store[TKey, TValue]) skipsLayer(layerIndex int, options loadOptions) bool {
+	if options.skips(layerIndex, len(r.layers)) {
+		return true
+	}
+
+	// cache layers have to be able to report the age of their values to serve loads with a maximum age
+	if options.maxAge > 0 && layerIndex < len(r.layers)-1 {
+		if _, ok := r.layers[layerIndex].(AgeLayer[TKey, TValue]); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// load values from a layer, treating values older than the given age as not found
+func getFresh[TKey comparable, TValue any](layer AgeLayer[TKey, TValue], keys []TKey, maxAge time.Duration) ([]TValue, []error) {
+	values, times, errors := layer.GetWithTime(keys)
+	if len(errors) == 0 {
+		errors = make([]error, len(keys))
+	}
+	oldest := time.Now().Add(-maxAge)
+	for i := range keys {
+		if errors[i] == nil && times[i].Before(oldest) {
+			errors[i] = NewErrNotFound(keys[i])
+		}
+	}
+	return values, errors
+}
+
 // extract a layer resolver result
 func group[TKey comparable, TValue any](keys []TKey, values []TValue, errors []error) (
 	[]int,
@@ -156,6 +268,26 @@ func group[TKey comparable, TValue any](keys []TKey, values []TValue, errors []e
 		unresolvedErrors[:unresolvedCounter]
 }
 
+// call finishKey for the unresolved keys with an authoritative not found error and return the remaining keys
+func finishAuthoritative[TKey comparable, TValue any](
+	resultIndexes []int,
+	indexes []int,
+	keys []TKey,
+	errors []error,
+	finishKey func(index int, value TValue, err error),
+) ([]int, []TKey, []error) {
+	remaining := 0
+	for i := range keys {
+		if err, ok := errors[i].(interface{ Authoritative() bool }); ok && err.Authoritative() {
+			finishKey(resultIndexes[indexes[i]], zero[TValue](), errors[i])
+			continue
+		}
+		indexes[remaining], keys[remaining], errors[remaining] = indexes[i], keys[i], errors[i]
+		remaining++
+	}
+	return indexes[:remaining], keys[:remaining], errors[:remaining]
+}
+
 // write the values from the source array into the destination array based on the given indexes
 func mergeWithIndexes[T any](destination []T, source []T, indexes []int) {
 	for i, dstIndex := range indexes {
@@ -0,0 +1,138 @@
+package lapis
+
+import (
+	"container/heap"
+	"time"
+)
+
+// batchQueue is a min-heap of batches ordered by their dispatch deadline
+type batchQueue[TKey comparable, TValue any] []*batch[TKey, TValue]
+
+func (q batchQueue[TKey, TValue]) Len() int { return len(q) }
+
+func (q batchQueue[TKey, TValue]) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q batchQueue[TKey, TValue]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].heapIndex = i
+	q[j].heapIndex = j
+}
+
+func (q *batchQueue[TKey, TValue]) Push(x any) {
+	b := x.(*batch[TKey, TValue])
+	b.heapIndex = len(*q)
+	*q = append(*q, b)
+}
+
+func (q *batchQueue[TKey, TValue]) Pop() any {
+	old := *q
+	n := len(old)
+	b := old[n-1]
+	old[n-1] = nil
+	b.heapIndex = -1
+	*q = old[:n-1]
+	return b
+}
+
+// schedule a new batch to be dispatched after the batcher wait time, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) schedule(b *batch[TKey, TValue]) {
+	b.wait = l.nextWait()
+	b.deadline = time.Now().Add(b.wait)
+	heap.Push(&l.queue, b)
+
+	// wake the scheduler up if the new batch is the earliest one
+	if b.heapIndex == 0 {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatch a batch that is full or has passed its deadline, must be called while holding the lock
+// If the maximum number of concurrently resolving batches is reached, the batch will be queued and
+// will keep accepting keys until it is full or until it is started
+func (l *Batcher[TKey, TValue]) dispatch(b *batch[TKey, TValue]) {
+	if b.closing {
+		return
+	}
+	if b.heapIndex >= 0 {
+		heap.Remove(&l.queue, b.heapIndex)
+	}
+	if l.maxConcurrentBatches > 0 && l.inFlight >= l.maxConcurrentBatches {
+		if !b.queued {
+			b.queued = true
+			l.waiting = append(l.waiting, b)
+		}
+		if l.maxBatch != 0 && len(b.keys) >= l.maxBatch {
+			l.removePendingBatch(b)
+		}
+		return
+	}
+	l.start(b)
+}
+
+// close the batch and start resolving it, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) start(b *batch[TKey, TValue]) {
+	b.closing = true
+	l.inFlight++
+	l.removePendingBatch(b)
+	go b.resolveBatch(l)
+}
+
+// start the oldest queued batch if there is a free slot, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) startWaiting() {
+	if len(l.waiting) == 0 || (l.maxConcurrentBatches > 0 && l.inFlight >= l.maxConcurrentBatches) {
+		return
+	}
+	b := l.waiting[0]
+	l.waiting[0] = nil
+	l.waiting = l.waiting[1:]
+	l.start(b)
+}
+
+// check if new batches should be rejected, must be called while holding the lock
+func (l *Batcher[TKey, TValue]) overloaded() bool {
+	return l.maxQueuedBatches > 0 && len(l.waiting) >= l.maxQueuedBatches
+}
+
+// run the scheduler loop which dispatches batches when their deadline has passed
+// a single scheduler goroutine serves all batches of a batcher until the batcher is closed
+func (l *Batcher[TKey, TValue]) runScheduler() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		for len(l.queue) > 0 && !l.queue[0].deadline.After(now) {
+			l.dispatch(l.queue[0])
+		}
+		next := time.Duration(-1)
+		if len(l.queue) > 0 {
+			next = l.queue[0].deadline.Sub(now)
+		}
+		l.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next < 0 {
+			select {
+			case <-l.wake:
+			case <-l.closed:
+				return
+			}
+			continue
+		}
+		timer.Reset(next)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
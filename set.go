@@ -4,29 +4,16 @@ import "sync"
 
 // Set a set of data to all of layers
 // Returns an array of array of errors with the first dimension as the key and second dimension as the layer
+// With SetSequential the errors are in the order the layers are set, otherwise they are in the order of the layers
+// If a write mode is configured, the values are written to the final layer according to the mode and the errors
+// are always in the order of the layers
 func (r *Store[TKey, TValue]) SetAll(keys []TKey, values []TValue, flags ...SetFlag) [][]error {
-	layerIndexes := make([]int, len(r.layers))
-	if hasSetFlag(0, flags, SetSequential) {
-		var initial, iterationChange, endCondition int
-		if hasSetFlag(0, flags, SetAscending) {
-			initial = 0
-			iterationChange = 1
-			endCondition = len(r.layers)
-		} else {
-			initial = len(r.layers) - 1
-			iterationChange = -1
-			endCondition = -1
-		}
-		i := 0
-		for layerIndex := initial; layerIndex != endCondition; layerIndex = layerIndex + iterationChange {
-			layerIndexes[i] = layerIndex
-			i++
-		}
-		return r.set(layerIndexes, keys, values, true)
-	} else {
-		layerIndexes = generateSequence(len(r.layers))
-		return r.set(layerIndexes, keys, values, false)
+	if r.writeMode != WriteNone {
+		_, errors := r.write(keys, values, flags)
+		return errors
 	}
+	layerIndexes, sequential := setOrder(len(r.layers), flags)
+	return r.set(layerIndexes, keys, values, sequential)
 }
 
 // Set a specific key value into the store
@@ -35,68 +22,124 @@ func (r *Store[TKey, TValue]) Set(key TKey, value TValue, flags ...SetFlag) []er
 	return singlifyErrors(r.SetAll([]TKey{key}, []TValue{value}, flags...))
 }
 
+// get the order of the layers to be set from the set flags, and whether they should be set sequentially
+func setOrder(layerCount int, flags []SetFlag) ([]int, bool) {
+	if !hasSetFlag(0, flags, SetSequential) {
+		return generateSequence(layerCount), false
+	}
+	layerIndexes := generateSequence(layerCount)
+	if !hasSetFlag(0, flags, SetAscending) {
+		for i, j := 0, layerCount-1; i < j; i, j = i+1, j-1 {
+			layerIndexes[i], layerIndexes[j] = layerIndexes[j], layerIndexes[i]
+		}
+	}
+	return layerIndexes, true
+}
+
 // prime a set of KV data on all layers
 func (r *Store[TKey, TValue]) set(layerIndexes []int, keys []TKey, values []TValue, sequential bool) [][]error {
 	var traceID uint64 = r.getTraceID()
 	var errors = make([][]error, len(r.layers))
+	r.preSet(traceID, keys, values)
+	r.setLayers(traceID, layerIndexes, keys, values, sequential, errors)
+	r.postSet(traceID, keys, values, errors)
+	return errors
+}
 
-	// execute pre-set hook
+// execute the pre-set hooks
+func (r *Store[TKey, TValue]) preSet(traceID uint64, keys []TKey, values []TValue) {
 	if len(r.preSetHooks) > 0 {
 		// TODO block execution for error-returning
 		for _, hook := range r.preSetHooks {
-			hook.PreSetHook(traceID, keys, values)
+			capturedHook := hook
+			r.runHook(traceID, hook, func() {
+				capturedHook.PreSetHook(traceID, keys, values)
+			})
 		}
 	}
+}
 
-	if sequential {
-		for i, layerIndex := range layerIndexes {
-			errors[i] = r.layerSet(traceID, layerIndex, keys, values)
-		}
-	} else {
-		wg := sync.WaitGroup{}
-		wg.Add(len(r.layers))
-		for i, layerIndex := range layerIndexes {
-			capturedI := i
-			capturedLayerIndex := layerIndex
-			go func() {
-				defer wg.Done()
-				errors[capturedI] = r.layerSet(traceID, capturedLayerIndex, keys, values)
-			}()
-		}
-		wg.Wait()
-	}
-
-	// execute post-set hook
+// execute the post-set hooks and notify the watchers
+func (r *Store[TKey, TValue]) postSet(traceID uint64, keys []TKey, values []TValue, errors [][]error) {
 	if len(r.postSetHooks) > 0 {
 		for _, hook := range r.postSetHooks {
-			hook.PostSetHook(traceID, keys, values, errors)
+			capturedHook := hook
+			r.runHook(traceID, hook, func() {
+				capturedHook.PostSetHook(traceID, keys, values, errors)
+			})
 		}
 	}
-
-	return errors
+	r.notify(keys)
 }
 
-// prime a set of KV data on one layer
-func (r *Store[TKey, TValue]) layerSet(traceID uint64, layerIndex int, keys []TKey, values []TValue) []error {
-	layer := r.layers[layerIndex]
+// prime a set of KV data on the given layers, the errors of each layer are written into the errors array at the
+// position of the layer in layerIndexes
+func (r *Store[TKey, TValue]) setLayers(traceID uint64, layerIndexes []int, keys []TKey, values []TValue, sequential bool, errors [][]error) {
+	if sequential {
+		for i, layerIndex := range layerIndexes {
+			errors[i] = r.layerSet(traceID, layerIndex, keys, values, nil)
+		}
+		return
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(len(layerIndexes))
+	for i, layerIndex := range layerIndexes {
+		capturedI := i
+		capturedLayerIndex := layerIndex
+		go func() {
+			defer wg.Done()
+			errors[capturedI] = r.layerSet(traceID, capturedLayerIndex, keys, values, nil)
+		}()
+	}
+	wg.Wait()
+}
 
+// prime a set of KV data on one layer, leases are given when priming keys leased by the layer
+func (r *Store[TKey, TValue]) layerSet(traceID uint64, layerIndex int, keys []TKey, values []TValue, leases []Lease) []error {
 	// execute layer pre-set hook
 	if len(r.layerPreSetHooks) > 0 {
 		// TODO block execution for error-returning
 		for _, hook := range r.layerPreSetHooks {
-			hook.LayerPreSetHook(traceID, layerIndex, keys, values)
+			capturedHook := hook
+			r.runHook(traceID, hook, func() {
+				capturedHook.LayerPreSetHook(traceID, layerIndex, keys, values)
+			})
 		}
 	}
 
 	// execute the layer set operation
-	errors := layer.Set(keys, values)
+	errors := r.layerSetValues(traceID, layerIndex, keys, values, leases)
 
 	// execute layer post-set hook
 	if len(r.layerPostSetHooks) > 0 {
 		for _, hook := range r.layerPostSetHooks {
-			hook.LayerPostSetHook(traceID, layerIndex, keys, values, errors)
+			capturedHook := hook
+			r.runHook(traceID, hook, func() {
+				capturedHook.LayerPostSetHook(traceID, layerIndex, keys, values, errors)
+			})
 		}
 	}
 
 	return errors
 }
+
+// set values into a layer, with their metadata if the layer supports it
+func (r *Store[TKey, TValue]) setLayer(layer Layer[TKey, TValue], keys []TKey, values []TValue, leases []Lease) []error {
+	if entryLayer, ok := layer.(EntryLayer[TKey, TValue]); ok && (r.version != nil || r.tags != nil || leases != nil) {
+		entries := make([]Entry[TValue], len(values))
+		for i, value := range values {
+			entries[i].Value = value
+			if r.version != nil {
+				entries[i].Version = r.version(value)
+			}
+			if r.tags != nil {
+				entries[i].Tags = r.tags(keys[i], value)
+			}
+			if leases != nil {
+				entries[i].Lease = leases[i]
+			}
+		}
+		return entryLayer.SetEntries(keys, entries)
+	}
+	return layer.Set(keys, values)
+}
@@ -11,8 +11,8 @@ type StaticStore[TValue any] struct {
 }
 
 // Get data from the store
-func (r *StaticStore[TValue]) Get(value TValue, flags ...LoadFlag) (TValue, error) {
-	return r.store.Load(staticTypePlaceholder{}, flags...)
+func (r *StaticStore[TValue]) Get(value TValue, options ...LoadOption) (TValue, error) {
+	return r.store.Load(staticTypePlaceholder{}, options...)
 }
 
 // Set the store data to all of the layers
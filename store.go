@@ -1,8 +1,11 @@
 package lapis
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/flowscan/lapis/internal/fallback"
 )
 
 type Store[TKey comparable, TValue any] struct {
@@ -12,8 +15,11 @@ type Store[TKey comparable, TValue any] struct {
 	// data resolver layers in this store
 	layers []Layer[TKey, TValue]
 
+	// identifiers of the layers in this store
+	layerIdentifiers []string
+
 	// batcher if batching is enabled
-	batcher Batcher[TKey, TValue]
+	batcher *Batcher[TKey, TValue]
 
 	// trace counter for trace ID assignment
 	traceCounter uint64
@@ -24,6 +30,28 @@ type Store[TKey comparable, TValue any] struct {
 	// default load flags
 	defaultLoadFlags LoadFlag
 
+	// version extractor for versioned writes
+	version func(value TValue) int64
+
+	// tag extractor for tag-based invalidation
+	tags func(key TKey, value TValue) []string
+
+	// hot miss retry configuration for lease layers
+	leaseWait    time.Duration
+	leaseRetries int
+
+	// writes to the final layer if a write mode is configured
+	writeMode  WriteMode
+	writer     Writer[TKey, TValue]
+	writeQueue *writeQueue[TKey, TValue]
+
+	// functions called with the keys of every set or write, used by derived stores
+	watchers   []func(keys []TKey)
+	watchersMu sync.RWMutex
+
+	// invalidation counters of derived stores, nil for other stores
+	generations *derivedGenerations
+
 	// hooks
 	initializationHooks []InitializationHookExtension[TKey, TValue]
 	preLoadHooks        []PreLoadHookExtension[TKey, TValue]
@@ -34,6 +62,8 @@ type Store[TKey comparable, TValue any] struct {
 	postSetHooks        []PostSetHookExtension[TKey, TValue]
 	layerPreSetHooks    []LayerPreSetHookExtension[TKey, TValue]
 	layerPostSetHooks   []LayerPostSetHookExtension[TKey, TValue]
+	batchDispatchHooks  []BatchDispatchHookExtension[TKey, TValue]
+	panicHooks          []PanicHookExtension[TKey, TValue]
 }
 
 // Get the identifier of the store
@@ -41,6 +71,19 @@ func (r *Store[TKey, TValue]) Identifier() string {
 	return r.identifier
 }
 
+// Stop the background goroutines of the store, pending batched loads and later batched loads fail with ErrClosed
+// In the write-behind mode, Close blocks until the queued writes are written and later writes fail with ErrClosed
+// Loads that don't use the batcher keep working, the layers are not closed
+func (r *Store[TKey, TValue]) Close() error {
+	if r.writeQueue != nil {
+		r.writeQueue.close()
+	}
+	if r.batcher != nil {
+		return r.batcher.Close()
+	}
+	return nil
+}
+
 func (r *Store[TKey, TValue]) getTraceID() uint64 {
 	return atomic.AddUint64(&r.traceCounter, 1)
 }
@@ -48,25 +91,52 @@ func (r *Store[TKey, TValue]) getTraceID() uint64 {
 // Create a new data store with the given configuration
 func New[TKey comparable, TValue any](config Config[TKey, TValue]) (*Store[TKey, TValue], error) {
 	r := &Store[TKey, TValue]{
-		layers:     config.Layers,
-		identifier: config.Identifier,
+		layers:           config.Layers,
+		identifier:       config.Identifier,
+		defaultLoadFlags: config.DefaultLoadFlags,
+		version:          config.Version,
+		tags:             config.Tags,
+		leaseWait:        fallback.Zero(config.Lease.Wait, 10*time.Millisecond),
+		leaseRetries:     fallback.Zero(config.Lease.Retries, 10),
 	}
-	if config.Batcher.MaxBatch > 0 {
-		r.useBatcher = true
-		r.batcher = Batcher[TKey, TValue]{
-			resolver: r.resolve,
-			wait:     zeroFallback(config.Batcher.Wait, 1*time.Millisecond),
-			maxBatch: zeroFallback(config.Batcher.MaxBatch, 256),
-			batches:  make(map[TKey]*batch[TKey, TValue]),
+	r.layerIdentifiers = make([]string, len(config.Layers))
+	for i, layer := range config.Layers {
+		r.layerIdentifiers[i] = layer.Identifier()
+	}
+	r.registerExtensions(config.Extensions)
+
+	if config.Write.Mode != WriteNone {
+		if len(config.Layers) == 0 {
+			return nil, ErrNotWritable
+		}
+		writer, ok := config.Layers[len(config.Layers)-1].(Writer[TKey, TValue])
+		if !ok {
+			return nil, ErrNotWritable
+		}
+		r.writeMode = config.Write.Mode
+		r.writer = writer
+		if r.writeMode == WriteBehind {
+			r.writeQueue = newWriteQueue(config.Write, r.writeBatch)
 		}
 	}
 
-	r.registerExtensions(config.Extensions)
+	if config.Batcher != nil && config.Batcher.MaxBatch > 0 {
+		r.useBatcher = true
+		r.batcher = newBatcher(*config.Batcher, r.resolve, config.DefaultLoadFlags, r.layerIdentifiers, r.batchDispatch)
+	}
 
 	// Execute initialization hooks
 	for _, hook := range r.initializationHooks {
-		err := hook.InitializationHook(r, config.Layers)
+		var err error
+		capturedHook := hook
+		if panicErr := r.runHook(0, hook, func() {
+			err = capturedHook.InitializationHook(r, config.Layers)
+		}); panicErr != nil {
+			r.Close()
+			return nil, panicErr
+		}
 		if err != nil {
+			r.Close()
 			return nil, err
 		}
 	}
@@ -84,6 +154,8 @@ func (r *Store[TKey, TValue]) registerExtensions(extensions []Extension) {
 	r.postSetHooks = make([]PostSetHookExtension[TKey, TValue], 0)
 	r.layerPreSetHooks = make([]LayerPreSetHookExtension[TKey, TValue], 0)
 	r.layerPostSetHooks = make([]LayerPostSetHookExtension[TKey, TValue], 0)
+	r.batchDispatchHooks = make([]BatchDispatchHookExtension[TKey, TValue], 0)
+	r.panicHooks = make([]PanicHookExtension[TKey, TValue], 0)
 	for _, ext := range extensions {
 		if ext, ok := ext.(InitializationHookExtension[TKey, TValue]); ok {
 			r.initializationHooks = append(r.initializationHooks, ext)
@@ -112,5 +184,21 @@ func (r *Store[TKey, TValue]) registerExtensions(extensions []Extension) {
 		if ext, ok := ext.(LayerPostSetHookExtension[TKey, TValue]); ok {
 			r.layerPostSetHooks = append(r.layerPostSetHooks, ext)
 		}
+		if ext, ok := ext.(BatchDispatchHookExtension[TKey, TValue]); ok {
+			r.batchDispatchHooks = append(r.batchDispatchHooks, ext)
+		}
+		if ext, ok := ext.(PanicHookExtension[TKey, TValue]); ok {
+			r.panicHooks = append(r.panicHooks, ext)
+		}
+	}
+}
+
+// execute the batch dispatch hooks
+func (r *Store[TKey, TValue]) batchDispatch(keys []TKey, wait time.Duration) {
+	for _, hook := range r.batchDispatchHooks {
+		capturedHook := hook
+		r.runHook(0, hook, func() {
+			capturedHook.BatchDispatchHook(keys, wait)
+		})
 	}
 }
@@ -1,9 +1,20 @@
 package lapis_test
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -180,6 +191,24 @@ func TestSet(t *testing.T) {
 	assert.True(t, errorRatePct < 10)
 }
 
+func TestSetSequential(t *testing.T) {
+	failing := &FailingLayer{Layer: layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour})}
+	failing.SetDown(true)
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestSetSequential",
+		Layers: []lapis.Layer[int, int]{
+			failing,
+			&CountingBackend{},
+		},
+	})
+	assert.Nil(t, err)
+
+	// sequential sets report the errors in the order the layers are set
+	assert.Equal(t, []error{nil, errReplicaDown}, store.Set(1, 1, lapis.SetSequential))
+	assert.Equal(t, []error{errReplicaDown, nil}, store.Set(1, 1, lapis.SetSequential, lapis.SetAscending))
+	assert.Equal(t, []error{errReplicaDown, nil}, store.Set(1, 1))
+}
+
 func TestPartialError(t *testing.T) {
 	backend := &NotPrimeOnlyBackend{fakeDelay: 100 * time.Millisecond}
 	store, err := lapis.New(lapis.Config[int, int]{
@@ -345,3 +374,1528 @@ func randDuration(from time.Duration, to time.Duration) time.Duration {
 	delta := to - from
 	return from + time.Duration(rand.Float64()*float64(delta))
 }
+
+func TestLoadOptions(t *testing.T) {
+	backend := &CountingBackend{multiplier: 1}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestLoadOptions",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 256,
+		},
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			backend,
+		},
+	})
+	assert.Nil(t, err)
+
+	// a cache-only load never reaches the backend
+	_, err = store.Load(1, lapis.LoadCacheOnly)
+	assert.IsType(t, lapis.ErrNotFound[int]{}, err)
+	assert.Equal(t, 0, backend.Count())
+
+	res, err := store.Load(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 1, backend.Count())
+	time.Sleep(10 * time.Millisecond)
+
+	// cached values are served from the memory layer
+	backend.SetMultiplier(2)
+	res, err = store.Load(1, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res)
+	res, err = store.Load(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 1, backend.Count())
+
+	// skipping the memory layer loads from the backend
+	res, err = store.Load(1, lapis.LoadSkipLayer("memory"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res)
+	assert.Equal(t, 2, backend.Count())
+
+	// refreshing loads from the backend and primes the memory layer
+	backend.SetMultiplier(3)
+	res, err = store.Load(1, lapis.LoadRefresh)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res)
+	time.Sleep(10 * time.Millisecond)
+	res, err = store.Load(1, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res)
+
+	// cached values older than the maximum age are reloaded
+	backend.SetMultiplier(4)
+	time.Sleep(20 * time.Millisecond)
+	res, err = store.Load(1, lapis.LoadMaxAge(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res)
+	res, err = store.Load(1, lapis.LoadMaxAge(10*time.Millisecond))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, res)
+
+	// unbatched loads use the same options
+	backend.SetMultiplier(5)
+	values, errors := store.LoadAll([]int{1, 2}, lapis.LoadNoBatch, lapis.LoadSkipLayers(1))
+	assert.Equal(t, []error{nil, nil}, errors)
+	assert.Equal(t, []int{5, 10}, values)
+}
+
+func TestFutures(t *testing.T) {
+	squareStore := newSquareMockStore(t, 50*time.Millisecond)
+	unbatchedStore, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestFuturesUnbatched",
+		Layers: []lapis.Layer[int, int]{
+			&CountingBackend{fakeDelay: 50 * time.Millisecond, multiplier: 2},
+		},
+	})
+	assert.Nil(t, err)
+
+	// fan out loads across both stores from one goroutine
+	square := squareStore.LoadFuture(3)
+	squares := squareStore.LoadAllFuture([]int{1, 2, 3})
+	doubles := unbatchedStore.LoadAllFuture([]int{1, 2, 3})
+	double := unbatchedStore.LoadThunk(4)
+	assert.Nil(t, lapis.Wait(context.Background(), square, squares, doubles))
+
+	res, err := square.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 9, res)
+	values, errors := squares.Get()
+	assert.Equal(t, []error{nil, nil, nil}, errors)
+	assert.Equal(t, []int{1, 4, 9}, values)
+	values, errors = doubles.Get()
+	assert.Equal(t, []error{nil, nil, nil}, errors)
+	assert.Equal(t, []int{2, 4, 6}, values)
+	res, err = double()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, res)
+
+	// waiting stops when the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = squareStore.LoadCtx(ctx, 10)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, errors = unbatchedStore.LoadAllCtx(ctx, []int{10, 11})
+	assert.Equal(t, []error{context.DeadlineExceeded, context.DeadlineExceeded}, errors)
+	res, err = squareStore.LoadCtx(context.Background(), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, res)
+}
+
+func TestLoadMapAndStream(t *testing.T) {
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestLoadMapAndStream",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 256,
+		},
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			&NotPrimeOnlyBackend{fakeDelay: 10 * time.Millisecond},
+		},
+	})
+	assert.Nil(t, err)
+
+	values, errors := store.LoadMap([]int{4, 5, 4, 6, 5})
+	assert.Equal(t, map[int]int{4: 4, 6: 6}, values)
+	assert.Len(t, errors, 1)
+	assert.IsType(t, lapis.ErrNotFound[int]{}, errors[5])
+
+	for _, options := range [][]lapis.LoadOption{nil, {lapis.LoadNoBatch}} {
+		received := make(map[int]int)
+		for result := range store.LoadStream([]int{8, 9, 10, 11, 8}, options...) {
+			_, duplicate := received[result.Key]
+			assert.False(t, duplicate)
+			if result.Key == 11 {
+				assert.NotNil(t, result.Err)
+			} else {
+				assert.Nil(t, result.Err)
+			}
+			received[result.Key] = result.Value
+		}
+		assert.Equal(t, map[int]int{8: 8, 9: 9, 10: 10, 11: 0}, received)
+	}
+}
+
+func TestPanicIsolation(t *testing.T) {
+	ext := &PanickingExtension{}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestPanicIsolation",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 256,
+		},
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			PanickingLayer{},
+		},
+		Extensions: []lapis.Extension{ext},
+	})
+	assert.Nil(t, err)
+
+	// a panicking layer fails every key of the call
+	values, errors := store.LoadAll([]int{1, 13})
+	assert.Equal(t, []int{0, 0}, values)
+	for _, err := range errors {
+		panicErr, ok := err.(lapis.ErrLayerPanic)
+		assert.True(t, ok)
+		assert.Equal(t, "PanickingLayer", panicErr.Layer)
+		assert.Equal(t, "unlucky get", panicErr.Value)
+		assert.NotEmpty(t, panicErr.Stack)
+	}
+
+	// other batches are not affected, also without the batcher
+	res, err := store.Load(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res)
+	_, err = store.Load(13, lapis.LoadNoBatch)
+	assert.IsType(t, lapis.ErrLayerPanic{}, err)
+
+	// panics in hooks and sets are reported to the panic hooks
+	store.Set(13, 13)
+	panics := ext.Panics()
+	var layerPanics, hookPanics int
+	for _, p := range panics {
+		if p.Extension == "PanickingExtension" {
+			hookPanics++
+		}
+		if p.Layer == "PanickingLayer" {
+			layerPanics++
+		}
+	}
+	assert.True(t, hookPanics > 0)
+	assert.Equal(t, 3, layerPanics)
+}
+
+func TestResolvePanic(t *testing.T) {
+	recorder := &PanicRecorder{}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestResolvePanic",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 256,
+		},
+		Layers:     []lapis.Layer[int, int]{MalformedLayer{}},
+		Extensions: []lapis.Extension{recorder},
+	})
+	assert.Nil(t, err)
+
+	// malformed layer results fail the unfinished keys, with and without the batcher
+	for _, flags := range [][]lapis.LoadOption{nil, {lapis.LoadNoBatch}} {
+		_, errors := store.LoadAll([]int{1, 2}, flags...)
+		for _, err := range errors {
+			panicErr, ok := err.(lapis.ErrLayerPanic)
+			assert.True(t, ok)
+			assert.Equal(t, "MalformedLayer", panicErr.Layer)
+			assert.NotEmpty(t, panicErr.Stack)
+		}
+	}
+	for result := range store.LoadStream([]int{3, 4}) {
+		assert.IsType(t, lapis.ErrLayerPanic{}, result.Err)
+	}
+	assert.Equal(t, 3, recorder.Count())
+}
+
+func TestVersionedSet(t *testing.T) {
+	// values are versioned by their thousands
+	backend := &CountingBackend{fakeDelay: 50 * time.Millisecond, multiplier: 1000}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestVersionedSet",
+		Batcher: &lapis.BatcherConfig[int, int]{
+			MaxBatch: 256,
+		},
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			backend,
+		},
+		Version: func(value int) int64 {
+			return int64(value / 1000)
+		},
+	})
+	assert.Nil(t, err)
+
+	// a load that started before a set won't overwrite the newer value
+	future := store.LoadFuture(1)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []error{nil, nil}, store.Set(1, 2000))
+	res, err := future.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, res)
+	time.Sleep(10 * time.Millisecond)
+	res, err = store.Load(1, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, res)
+
+	// older versions are rejected, newer versions are accepted
+	assert.Equal(t, lapis.ErrStaleVersion, store.Set(1, 1500)[0])
+	assert.Nil(t, store.Set(1, 3000)[0])
+	res, err = store.Load(1, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 3000, res)
+}
+
+func TestLeases(t *testing.T) {
+	backend := &CountingBackend{fakeDelay: 50 * time.Millisecond, multiplier: 1}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestLeases",
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour, LeaseTTL: time.Second}),
+			backend,
+		},
+		Lease: lapis.LeaseConfig{Wait: 20 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// only the loader holding the lease loads from the backend, the others wait for the value to be filled
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := store.Load(1)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, res)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, backend.Count())
+
+	// a set while the value is being loaded revokes the lease, so the loaded value won't overwrite it
+	future := store.LoadFuture(2)
+	time.Sleep(10 * time.Millisecond)
+	store.Set(2, 200)
+	res, err := future.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res)
+	time.Sleep(10 * time.Millisecond)
+	res, err = store.Load(2, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res)
+
+	// loads with a max age read the layer without leases, so every loader missing the key loads from the backend
+	wg = sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := store.Load(3, lapis.LoadMaxAge(time.Minute))
+			assert.Nil(t, err)
+			assert.Equal(t, 3, res)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 12, backend.Count())
+	res, err = store.Load(3, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res)
+}
+
+func TestWriteThrough(t *testing.T) {
+	backend := &WritableBackend{data: make(map[int]int)}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestWriteThrough",
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			backend,
+		},
+		Write: lapis.WriteConfig{Mode: lapis.WriteThrough},
+	})
+	assert.Nil(t, err)
+
+	// only the values accepted by the final layer are primed
+	errors := store.SetAll([]int{1, -1}, []int{10, 20})
+	assert.Nil(t, errors[1][0])
+	assert.NotNil(t, errors[1][1])
+	res, err := store.Load(1, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, res)
+	_, err = store.Load(-1, lapis.LoadCacheOnly)
+	assert.NotNil(t, err)
+
+	// write futures are already resolved in the write-through mode
+	futures := store.WriteAll([]int{2, -2}, []int{20, 40})
+	values, errs := futures.Get()
+	assert.Equal(t, []int{20, 40}, values)
+	assert.Nil(t, errs[0])
+	assert.NotNil(t, errs[1])
+
+	// the final layer must implement Writer
+	_, err = lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{&CountingBackend{}},
+		Write:  lapis.WriteConfig{Mode: lapis.WriteThrough},
+	})
+	assert.Equal(t, lapis.ErrNotWritable, err)
+}
+
+func TestWriteBehind(t *testing.T) {
+	backend := &WritableBackend{data: make(map[int]int), failures: 1}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestWriteBehind",
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			backend,
+		},
+		Write: lapis.WriteConfig{Mode: lapis.WriteBehind, Wait: 20 * time.Millisecond, RetryWait: time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// caches are primed right away while the writes are queued and batched
+	futures := store.WriteAll(generateKeys(100), generateKeys(100))
+	res, err := store.Load(5, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, res)
+	_, errs := futures.Get()
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+
+	// the temporary failure is retried in a second write
+	assert.Equal(t, 2, backend.Writes())
+	res, err = store.Load(99, lapis.LoadSkipLayers(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 99, res)
+
+	// permanent failures are reported after the retries are exhausted
+	future := store.Write(-1, 1)
+	store.Set(200, 1)
+	store.Set(200, 2)
+	assert.Nil(t, store.Flush(context.Background()))
+	_, err = future.Get()
+	assert.NotNil(t, err)
+	res, err = store.Load(200, lapis.LoadSkipLayers(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res)
+
+	// closing writes the queued writes before stopping the writer, later writes are rejected
+	future = store.Write(300, 3)
+	assert.Nil(t, store.Close())
+	select {
+	case <-future.Done():
+	default:
+		t.Fatal("queued write is not finished after closing")
+	}
+	res, err = store.Load(300, lapis.LoadSkipLayers(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res)
+	_, err = store.Write(301, 1).Get()
+	assert.Equal(t, lapis.ErrClosed, err)
+	assert.Nil(t, store.Close())
+}
+
+func TestInvalidateTag(t *testing.T) {
+	backend := &CountingBackend{multiplier: 1}
+	store, err := lapis.New(lapis.Config[int, int]{
+		Identifier: "TestInvalidateTag",
+		Layers: []lapis.Layer[int, int]{
+			layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour}),
+			backend,
+		},
+		Tags: func(key int, value int) []string {
+			if value%2 == 0 {
+				return []string{"even"}
+			}
+			return []string{"odd"}
+		},
+	})
+	assert.Nil(t, err)
+
+	_, errs := store.LoadAll(generateKeys(10))
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// values stored again with other tags are moved to the new tags
+	store.Set(4, 5)
+	assert.Equal(t, []error{nil, nil}, store.InvalidateTag("even"))
+	for _, key := range generateKeys(10) {
+		_, err := store.Load(key, lapis.LoadCacheOnly)
+		if key%2 == 0 && key != 4 {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	store.InvalidateTag("odd")
+	_, err = store.Load(4, lapis.LoadCacheOnly)
+	assert.NotNil(t, err)
+}
+
+func TestWarm(t *testing.T) {
+	newStore := func() (*lapis.Store[int, int], *layer.Memory[int, int], *CountingBackend) {
+		memory := layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour})
+		backend := &CountingBackend{multiplier: 1}
+		store, err := lapis.New(lapis.Config[int, int]{
+			Identifier: "TestWarm",
+			Layers:     []lapis.Layer[int, int]{memory, backend},
+		})
+		assert.Nil(t, err)
+		return store, memory, backend
+	}
+
+	// keys are loaded in batches at the configured rate
+	store, memory, backend := newStore()
+	var batches int
+	start := time.Now()
+	progress, err := store.Warm(context.Background(), lapis.KeyList(generateKeys(200)), lapis.WarmConfig{
+		BatchSize: 50,
+		Rate:      1000,
+		Progress:  func(progress lapis.WarmProgress) { batches++ },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 200, progress.Loaded)
+	assert.Equal(t, 4, batches)
+	assert.Equal(t, 200, backend.Count())
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	// another instance is warmed from a snapshot of the keys held by the first instance
+	snapshot := bytes.Buffer{}
+	assert.Nil(t, lapis.WriteKeySnapshot(&snapshot, memory.Keys()))
+	other, _, otherBackend := newStore()
+	progress, err = other.Warm(context.Background(), lapis.KeySnapshot[int](&snapshot), lapis.WarmConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, 200, progress.Loaded)
+	assert.Equal(t, 200, otherBackend.Count())
+	time.Sleep(10 * time.Millisecond)
+	res, err := other.Load(150, lapis.LoadCacheOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, 150, res)
+
+	// warming stops when the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.Warm(ctx, lapis.KeyList(generateKeys(10)), lapis.WarmConfig{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	memory := layer.NewMemory[int, *int](layer.MemoryConfig{Retention: 10 * time.Hour, Codec: lapis.JSONCodec{}})
+	value := 10
+	memory.Set([]int{1, 2, 3}, []*int{&value, nil, &value})
+	snapshot := bytes.Buffer{}
+	assert.Nil(t, memory.Export(&snapshot))
+
+	// restored entries keep their expiration and values already held are kept
+	restored := layer.NewMemory[int, *int](layer.MemoryConfig{Retention: 10 * time.Hour, Codec: lapis.JSONCodec{}})
+	other := 20
+	restored.Set([]int{1}, []*int{&other})
+	assert.Nil(t, restored.Restore(&snapshot))
+	values, errs := restored.Get([]int{1, 2, 3})
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, 20, *values[0])
+	assert.Nil(t, values[1])
+	assert.Equal(t, 10, *values[2])
+
+	// expired entries are not restored
+	short := layer.NewMemory[int, int](layer.MemoryConfig{Retention: 20 * time.Millisecond})
+	short.Set([]int{1}, []int{1})
+	snapshot.Reset()
+	assert.Nil(t, short.Export(&snapshot))
+	time.Sleep(30 * time.Millisecond)
+	restoredShort := layer.NewMemory[int, int](layer.MemoryConfig{Retention: 20 * time.Millisecond})
+	assert.Nil(t, restoredShort.Restore(&snapshot))
+	_, errs = restoredShort.Get([]int{1})
+	assert.NotNil(t, errs[0])
+
+	// restored entries expire on time even when they are scheduled behind later expirations
+	short.Set([]int{2}, []int{2})
+	snapshot.Reset()
+	assert.Nil(t, short.Export(&snapshot))
+	long := layer.NewMemory[int, int](layer.MemoryConfig{Retention: 10 * time.Hour})
+	long.Set([]int{1}, []int{1})
+	assert.Nil(t, long.Restore(&snapshot))
+	_, errs = long.Get([]int{1, 2})
+	assert.Equal(t, []error{nil, nil}, errs)
+	time.Sleep(30 * time.Millisecond)
+	_, errs = long.Get([]int{1, 2})
+	assert.Equal(t, []error{nil, lapis.NewErrNotFound(2)}, errs)
+	assert.Equal(t, []int{1}, long.Keys())
+}
+
+func TestDiskLayer(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := layer.NewDisk[int, string](layer.DiskConfig{Dir: dir, SegmentSize: 1024})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, disk.Set([]int{i}, []string{fmt.Sprintf("value %d", i)}))
+	}
+	disk.Set([]int{1}, []string{"updated"})
+	assert.Nil(t, disk.Close())
+
+	// the index is recovered after a restart, ignoring a partially written record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+layer.DiskSegmentExtension))
+	assert.Greater(t, len(segments), 1)
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+	disk, err = layer.NewDisk[int, string](layer.DiskConfig{Dir: dir, SegmentSize: 1024})
+	assert.Nil(t, err)
+	values, errs := disk.Get([]int{0, 1, 99, 100})
+	assert.Equal(t, []string{"value 0", "updated", "value 99", ""}, values)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[2])
+	assert.NotNil(t, errs[3])
+	assert.Nil(t, disk.Set([]int{100}, []string{"value 100"}))
+	values, _ = disk.Get([]int{100})
+	assert.Equal(t, "value 100", values[0])
+
+	// compaction rewrites segments made of overwritten records
+	for i := 0; i < 100; i++ {
+		disk.Set([]int{i}, []string{fmt.Sprintf("new value %d", i)})
+	}
+	disk.Compact()
+	values, errs = disk.Get([]int{0, 50})
+	assert.Equal(t, []string{"new value 0", "new value 50"}, values)
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Nil(t, disk.Close())
+
+	// the oldest segments are evicted once the size limit is exceeded
+	capped, err := layer.NewDisk[int, string](layer.DiskConfig{Dir: t.TempDir(), SegmentSize: 1024, MaxSize: 4096})
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		capped.Set([]int{i}, []string{fmt.Sprintf("value %d", i)})
+	}
+	_, errs = capped.Get([]int{0, 999})
+	assert.NotNil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Nil(t, capped.Close())
+	assert.Nil(t, capped.Close())
+
+	// the records just set are kept when the limit is smaller than a segment
+	tiny, err := layer.NewDisk[int, string](layer.DiskConfig{Dir: t.TempDir(), SegmentSize: 1024, MaxSize: 64})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, tiny.Set([]int{i, i + 1000}, []string{fmt.Sprintf("value %d", i), fmt.Sprintf("value %d", i+1000)}))
+		values, errs := tiny.Get([]int{i, i + 1000})
+		assert.Equal(t, []error{nil, nil}, errs)
+		assert.Equal(t, []string{fmt.Sprintf("value %d", i), fmt.Sprintf("value %d", i+1000)}, values)
+	}
+	_, errs = tiny.Get([]int{0})
+	assert.NotNil(t, errs[0])
+	assert.Nil(t, tiny.Close())
+
+	// a record length beyond the end of the file is corrupted, the segment is truncated before it
+	dir = t.TempDir()
+	disk, err = layer.NewDisk[int, string](layer.DiskConfig{Dir: dir})
+	assert.Nil(t, err)
+	disk.Set([]int{1}, []string{"value 1"})
+	assert.Nil(t, disk.Close())
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+layer.DiskSegmentExtension))
+	info, err := os.Stat(segments[0])
+	assert.Nil(t, err)
+	file, err = os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 42})
+	file.Close()
+	disk, err = layer.NewDisk[int, string](layer.DiskConfig{Dir: dir})
+	assert.Nil(t, err)
+	values, errs = disk.Get([]int{1})
+	assert.Equal(t, []string{"value 1"}, values)
+	assert.Nil(t, errs[0])
+	truncated, err := os.Stat(segments[0])
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+	assert.Nil(t, disk.Close())
+}
+
+func TestSQLLayer(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	fake := &FakeSQLDriver{rows: map[int64]string{1: "alice", 2: "bob", 3: "carol"}}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+	users, err := layer.NewSQL(layer.SQLConfig[int, user]{
+		DB:    db,
+		Query: "SELECT id, name FROM users WHERE id IN ({keys})",
+		Scan: func(rows *sql.Rows) (user, error) {
+			var u user
+			err := rows.Scan(&u.ID, &u.Name)
+			return u, err
+		},
+		Key:     func(u user) int { return u.ID },
+		MaxKeys: 2,
+	})
+	assert.Nil(t, err)
+	store, err := lapis.New(lapis.Config[int, user]{
+		Identifier: "TestSQLLayer",
+		Batcher:    &lapis.BatcherConfig[int, user]{MaxBatch: 256},
+		Layers:     []lapis.Layer[int, user]{users},
+	})
+	assert.Nil(t, err)
+
+	// batches are split into queries of at most 2 keys, rows are matched back to their keys
+	values, errs := store.LoadAll([]int{3, 4, 1})
+	assert.Equal(t, "carol", values[0].Name)
+	assert.Equal(t, "alice", values[2].Name)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[2])
+	assert.Equal(t, lapis.NewErrNotFound(4), errs[1])
+	assert.Equal(t, []FakeSQLQuery{
+		{Query: "SELECT id, name FROM users WHERE id IN (?, ?)", Args: []driver.Value{int64(3), int64(4)}},
+		{Query: "SELECT id, name FROM users WHERE id IN (?)", Args: []driver.Value{int64(1)}},
+	}, fake.Queries())
+
+	// each parameter style binds the keys to its placeholders
+	scan := func(rows *sql.Rows) (user, error) {
+		var u user
+		err := rows.Scan(&u.ID, &u.Name)
+		return u, err
+	}
+	for _, test := range []struct {
+		config  layer.SQLConfig[int, user]
+		queries []FakeSQLQuery
+	}{
+		{
+			config: layer.SQLConfig[int, user]{Query: "SELECT id, name FROM users WHERE id IN ({keys})"},
+			queries: []FakeSQLQuery{
+				{Query: "SELECT id, name FROM users WHERE id IN (?, ?, ?)", Args: []driver.Value{int64(3), int64(4), int64(1)}},
+			},
+		},
+		{
+			config: layer.SQLConfig[int, user]{Query: "SELECT id, name FROM users WHERE id IN ({keys})", ParameterStyle: layer.SQLDollar, MaxKeys: 2},
+			queries: []FakeSQLQuery{
+				{Query: "SELECT id, name FROM users WHERE id IN ($1, $2)", Args: []driver.Value{int64(3), int64(4)}},
+				{Query: "SELECT id, name FROM users WHERE id IN ($1)", Args: []driver.Value{int64(1)}},
+			},
+		},
+		{
+			config: layer.SQLConfig[int, user]{
+				Query:          "SELECT id, name FROM users WHERE id = ANY({keys})",
+				ParameterStyle: layer.SQLAny,
+				Array:          func(keys []int) any { return FakeSQLArray(keys) },
+			},
+			queries: []FakeSQLQuery{
+				{Query: "SELECT id, name FROM users WHERE id = ANY($1)", Args: []driver.Value{"{3,4,1}"}},
+			},
+		},
+	} {
+		test.config.DB, test.config.Scan, test.config.Key = db, scan, func(u user) int { return u.ID }
+		styled, err := layer.NewSQL(test.config)
+		assert.Nil(t, err)
+		values, errs := styled.Get([]int{3, 4, 1})
+		assert.Equal(t, []string{"carol", "", "alice"}, []string{values[0].Name, values[1].Name, values[2].Name})
+		assert.Equal(t, []error{nil, lapis.NewErrNotFound(4), nil}, errs)
+		assert.Equal(t, test.queries, fake.Queries())
+	}
+
+	// array parameters need a function to convert the keys
+	_, err = layer.NewSQL(layer.SQLConfig[int, user]{
+		DB:             db,
+		Query:          "SELECT id, name FROM users WHERE id = ANY({keys})",
+		ParameterStyle: layer.SQLAny,
+	})
+	assert.Equal(t, layer.ErrSQLNoArray, err)
+}
+
+func TestHTTPLayer(t *testing.T) {
+	type user struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	var requests []string
+	var mu sync.Mutex
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := r.URL.Query().Get("ids")
+		mu.Lock()
+		requests = append(requests, ids)
+		unavailable := len(requests)%2 == 1
+		mu.Unlock()
+		users := []user{}
+		for _, id := range strings.Split(ids, ",") {
+			switch id {
+			case "404":
+				http.Error(w, "no such user", http.StatusNotFound)
+				return
+			case "500":
+				http.Error(w, strings.Repeat("failure ", 1000), http.StatusInternalServerError)
+				return
+			case "503":
+				// every other request is unavailable
+				if unavailable {
+					http.Error(w, "try again", http.StatusServiceUnavailable)
+					return
+				}
+				users = append(users, user{ID: 503, Name: "user 503"})
+			case "999":
+				time.Sleep(200 * time.Millisecond)
+			case "3":
+				// missing entries are not found
+			default:
+				users = append(users, user{ID: atoi(id), Name: "user " + id})
+			}
+		}
+		json.NewEncoder(w).Encode(users)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	users, err := layer.NewHTTP(layer.HTTPConfig[int, user]{
+		Client:  &http.Client{},
+		Request: layer.HTTPGet[int](server.URL + "/users?ids={keys}"),
+		Key:     func(u user) int { return u.ID },
+		Timeout: 50 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	values, errs := users.Get([]int{1, 2, 3})
+	assert.Equal(t, []string{"1,2,3"}, requests)
+	assert.Equal(t, "user 1", values[0].Name)
+	assert.Equal(t, "user 2", values[1].Name)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Equal(t, lapis.NewErrNotFound(3), errs[2])
+
+	_, errs = users.Get([]int{404})
+	assert.Equal(t, lapis.NewErrNotFound(404), errs[0])
+
+	_, errs = users.Get([]int{1, 500})
+	statusErr, ok := errs[0].(layer.ErrHTTPStatus)
+	assert.True(t, ok)
+	assert.True(t, statusErr.Transient())
+
+	// the bodies of unsuccessful responses are drained so the connection is reused
+	_, errs = users.Get([]int{1})
+	assert.Equal(t, []error{nil}, errs)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+
+	// transient statuses are retried
+	retrying, err := layer.NewHTTP(layer.HTTPConfig[int, user]{
+		Request:   layer.HTTPGet[int](server.URL + "/users?ids={keys}"),
+		Key:       func(u user) int { return u.ID },
+		Retries:   1,
+		RetryWait: time.Millisecond,
+	})
+	assert.Nil(t, err)
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	values, errs = retrying.Get([]int{503})
+	assert.Equal(t, []error{nil}, errs)
+	assert.Equal(t, "user 503", values[0].Name)
+	_, errs = retrying.Get([]int{500})
+	assert.Equal(t, layer.ErrHTTPStatus{StatusCode: 500}, errs[0])
+	_, errs = retrying.Get([]int{404})
+	assert.Equal(t, lapis.NewErrNotFound(404), errs[0])
+	assert.Equal(t, []string{"503", "503", "500", "500", "404"}, requests)
+
+	// the request and key functions are required
+	_, err = layer.NewHTTP(layer.HTTPConfig[int, user]{Key: func(u user) int { return u.ID }})
+	assert.Equal(t, layer.ErrHTTPNoRequest, err)
+	_, err = layer.NewHTTP(layer.HTTPConfig[int, user]{Request: layer.HTTPGet[int](server.URL)})
+	assert.Equal(t, layer.ErrHTTPNoKey, err)
+
+	_, errs = users.Get([]int{999})
+	assert.ErrorIs(t, errs[0], context.DeadlineExceeded)
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+func TestMemcachedLayer(t *testing.T) {
+	server := NewFakeMemcached(t)
+	memcached := layer.NewMemcached[int, *string](layer.MemcachedConfig{
+		Address:   server.Address(),
+		KeyPrefix: "test:",
+		Retention: time.Hour,
+	})
+	defer memcached.Close()
+
+	value := "value"
+	assert.Equal(t, []error{nil, nil}, memcached.Set([]int{1, 2}, []*string{&value, nil}))
+	assert.Equal(t, int64(3600), server.Expiration("test:1"))
+
+	// nil values are stored with the nil constant and missing keys are not found
+	values, errs := memcached.Get([]int{1, 2, 3})
+	assert.Equal(t, "value", *values[0])
+	assert.Nil(t, values[1])
+	assert.Equal(t, []error{nil, nil, lapis.NewErrNotFound(3)}, errs)
+
+	// values rejected by the server fail on their own
+	server.SetMaxValueSize(100)
+	small, large := "small", strings.Repeat("large", 100)
+	errs = memcached.Set([]int{4, 5, 6}, []*string{&small, &large, &small})
+	assert.Equal(t, []error{nil, layer.ErrMemcached{Response: "SERVER_ERROR object too large for cache"}, nil}, errs)
+	values, errs = memcached.Get([]int{4, 5, 6})
+	assert.Equal(t, []error{nil, lapis.NewErrNotFound(5), nil}, errs)
+	assert.Equal(t, "small", *values[2])
+
+	// keys with whitespace can't be used in the text protocol
+	invalid := layer.NewMemcached[string, string](layer.MemcachedConfig{Address: server.Address()})
+	_, errs = invalid.Get([]string{"a b"})
+	assert.Equal(t, layer.ErrMemcachedInvalidKey, errs[0])
+}
+
+func TestStructFieldCodec(t *testing.T) {
+	type profile struct {
+		Name     string
+		Age      int    `lapis:"age"`
+		Internal string `lapis:"-"`
+		hidden   string
+	}
+	codec := layer.StructFieldCodec[*profile]{}
+	fields, err := codec.Encode(&profile{Name: "alice", Age: 30, Internal: "x", hidden: "y"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Name": `"alice"`, "age": "30"}, fields)
+
+	// partial updates only encode the updated field
+	fields["age"], err = codec.EncodeField("age", 31)
+	assert.Nil(t, err)
+	value, err := codec.Decode(fields)
+	assert.Nil(t, err)
+	assert.Equal(t, &profile{Name: "alice", Age: 31}, value)
+
+	_, err = codec.EncodeField("Internal", "x")
+	assert.Equal(t, layer.ErrUnknownField{Field: "Internal"}, err)
+}
+
+func TestRedisLayer(t *testing.T) {
+	redis := layer.NewRedis[int, string](layer.RedisConfig{
+		Connection: newFakeRedisPool(t),
+		KeyPrefix:  "user:",
+	})
+
+	// versioned values are only stored if they are newer than the stored version
+	assert.Equal(t, []error{nil, nil}, redis.SetEntries([]int{1, 2}, []lapis.Entry[string]{{Value: "a5", Version: 5}, {Value: "b1"}}))
+	assert.Equal(t, []error{lapis.ErrStaleVersion, nil}, redis.SetEntries([]int{1, 2}, []lapis.Entry[string]{{Value: "a3", Version: 3}, {Value: "b2"}}))
+	assert.Equal(t, []error{lapis.ErrStaleVersion}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "a5'", Version: 5}}))
+	assert.Equal(t, []error{nil}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "a6", Version: 6}}))
+	values, errs := redis.Get([]int{1, 2, 3})
+	assert.Equal(t, []string{"a6", "b2", ""}, values)
+	assert.Equal(t, []error{nil, nil, lapis.NewErrNotFound(3)}, errs)
+}
+
+func TestRedisLeases(t *testing.T) {
+	redis := layer.NewRedis[int, string](layer.RedisConfig{
+		Connection: newFakeRedisPool(t),
+		KeyPrefix:  "user:",
+		LeaseTTL:   time.Second,
+	})
+
+	// the first miss gets a lease, the next ones are hot misses
+	_, leases, errs := redis.GetLeased([]int{1, 2})
+	assert.NotZero(t, leases[0])
+	assert.NotZero(t, leases[1])
+	assert.IsType(t, lapis.ErrNotFound[int]{}, errs[0])
+	_, _, errs = redis.GetLeased([]int{1})
+	assert.Equal(t, []error{lapis.ErrHotMiss}, errs)
+
+	// only the lease holder can fill the key, filling it revokes the lease
+	assert.Equal(t, []error{lapis.ErrInvalidLease}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "forged", Lease: leases[0] + 1}}))
+	assert.Equal(t, []error{nil}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "a", Lease: leases[0]}}))
+	assert.Equal(t, []error{lapis.ErrInvalidLease}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "again", Lease: leases[0]}}))
+
+	// a set revokes the lease of a slow loader
+	redis.Set([]int{2}, []string{"b"})
+	assert.Equal(t, []error{lapis.ErrInvalidLease}, redis.SetEntries([]int{2}, []lapis.Entry[string]{{Value: "outdated", Lease: leases[1]}}))
+
+	values, _, errs := redis.GetLeased([]int{1, 2})
+	assert.Equal(t, []string{"a", "b"}, values)
+	assert.Equal(t, []error{nil, nil}, errs)
+}
+
+func TestRedisTags(t *testing.T) {
+	redis := layer.NewRedis[int, string](layer.RedisConfig{
+		Connection: newFakeRedisPool(t),
+		KeyPrefix:  "feed:",
+	})
+	assert.Equal(t, []error{nil, nil, nil}, redis.SetEntries([]int{1, 2, 3}, []lapis.Entry[string]{
+		{Value: "a", Version: 5, Tags: []string{"user:1"}},
+		{Value: "b", Tags: []string{"user:1", "user:2"}},
+		{Value: "c", Tags: []string{"user:2"}},
+	}))
+
+	// values carrying the tag are evicted along with their versions
+	assert.Nil(t, redis.InvalidateTags([]string{"user:1"}))
+	values, errs := redis.Get([]int{1, 2, 3})
+	assert.Equal(t, []error{lapis.NewErrNotFound(1), lapis.NewErrNotFound(2), nil}, errs)
+	assert.Equal(t, "c", values[2])
+	assert.Equal(t, []error{nil}, redis.SetEntries([]int{1}, []lapis.Entry[string]{{Value: "a1", Version: 1}}))
+	assert.Nil(t, redis.InvalidateTags(nil))
+}
+
+func TestRedisScanKeys(t *testing.T) {
+	redis := layer.NewRedis[int, string](layer.RedisConfig{
+		Connection: newFakeRedisPool(t),
+		KeyPrefix:  "user:",
+		LeaseTTL:   time.Second,
+	})
+	redis.SetEntries([]int{1, 2}, []lapis.Entry[string]{{Value: "a", Version: 1, Tags: []string{"team:1"}}, {Value: "b"}})
+	redis.GetLeased([]int{3})
+
+	// only the keys of the values are scanned, without the versions, leases, and tag sets
+	source := redis.ScanKeys(strconv.Atoi)
+	keys, err := source.NextKeys(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, keys)
+	keys, err = source.NextKeys(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	// keys failing to be parsed fail the scan
+	_, err = redis.ScanKeys(func(key string) (int, error) {
+		return 0, fmt.Errorf("unparsable key %s", key)
+	}).NextKeys(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestRedisHashLayer(t *testing.T) {
+	type profile struct {
+		Name string
+		Age  int
+	}
+	hashes := layer.NewRedisHash[int, *profile](layer.RedisHashConfig[*profile]{
+		Connection: newFakeRedisHashPool(t),
+		KeyPrefix:  "profile:",
+	})
+
+	assert.Equal(t, []error{nil, nil}, hashes.Set([]int{1, 2}, []*profile{{Name: "alice", Age: 30}, nil}))
+	assert.Nil(t, hashes.SetFields(1, map[string]any{"Age": 31}))
+	assert.Equal(t, lapis.NewErrNotFound(3), hashes.SetFields(3, map[string]any{"Age": 31}))
+	// a nil value can't be partially updated
+	assert.Equal(t, lapis.NewErrNotFound(2), hashes.SetFields(2, map[string]any{"Age": 31}))
+
+	values, errs := hashes.Get([]int{1, 2, 3})
+	assert.Equal(t, []error{nil, nil, lapis.NewErrNotFound(3)}, errs)
+	assert.Equal(t, &profile{Name: "alice", Age: 31}, values[0])
+	assert.Nil(t, values[1])
+}
+
+func TestShardedLayer(t *testing.T) {
+	newShards := func(count int) []layer.Shard[int, int] {
+		shards := make([]layer.Shard[int, int], count)
+		for i := range shards {
+			shards[i] = layer.Shard[int, int]{Layer: layer.NewMemory[int, int](layer.MemoryConfig{}), Name: fmt.Sprintf("shard-%d", i)}
+		}
+		return shards
+	}
+	shards := newShards(3)
+	sharded, err := layer.NewSharded(layer.ShardedConfig[int, int]{Shards: shards})
+	assert.Nil(t, err)
+
+	// keys are spread across the shards and reassembled in order
+	keys := generateKeys(3000)
+	assert.Nil(t, sharded.Set(keys, keys))
+	values, errs := sharded.Get(append(keys, 3000))
+	assert.Equal(t, keys, values[:3000])
+	assert.Equal(t, lapis.NewErrNotFound(3000), errs[3000])
+	for _, shard := range shards {
+		held := len(shard.Layer.(*layer.Memory[int, int]).Keys())
+		assert.InDelta(t, 1000, held, 300)
+	}
+
+	// adding a shard only moves the keys taken by the new shard
+	grown, err := layer.NewSharded(layer.ShardedConfig[int, int]{Shards: newShards(4)})
+	assert.Nil(t, err)
+	moved := 0
+	for _, key := range keys {
+		if before, after := sharded.ShardOf(key), grown.ShardOf(key); before != after {
+			assert.Equal(t, 3, after)
+			moved++
+		}
+	}
+	assert.InDelta(t, 750, moved, 250)
+
+	// weights change the share of the keys
+	weighted := newShards(2)
+	weighted[1].Weight = 3
+	heavySharded, err := layer.NewSharded(layer.ShardedConfig[int, int]{Shards: weighted})
+	assert.Nil(t, err)
+	heavy := 0
+	for _, key := range keys {
+		if heavySharded.ShardOf(key) == 1 {
+			heavy++
+		}
+	}
+	assert.InDelta(t, 2250, heavy, 300)
+
+	// a ring without points is rejected
+	_, err = layer.NewSharded(layer.ShardedConfig[int, int]{})
+	assert.Equal(t, layer.ErrShardedEmpty, err)
+	negative := newShards(2)
+	negative[0].Weight, negative[1].Weight = -1, -1
+	_, err = layer.NewSharded(layer.ShardedConfig[int, int]{Shards: negative})
+	assert.Equal(t, layer.ErrShardedEmpty, err)
+
+	// a panicking shard fails its own keys only
+	panicking, err := layer.NewSharded(layer.ShardedConfig[int, int]{Shards: []layer.Shard[int, int]{
+		{Layer: PanickingLayer{}, Name: "a"},
+		{Layer: layer.NewMemory[int, int](layer.MemoryConfig{}), Name: "b"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, panicking.ShardOf(13))
+	keys = generateKeys(100)
+	setErrs := panicking.Set(keys, keys)
+	_, errs = panicking.Get(keys)
+	for i, key := range keys {
+		if panicking.ShardOf(key) == 0 {
+			assert.IsType(t, lapis.ErrLayerPanic{}, setErrs[i])
+			assert.IsType(t, lapis.ErrLayerPanic{}, errs[i])
+			assert.Equal(t, "PanickingLayer", errs[i].(lapis.ErrLayerPanic).Layer)
+		} else {
+			assert.Nil(t, setErrs[i])
+			assert.Nil(t, errs[i])
+		}
+	}
+}
+
+func TestReplicatedLayer(t *testing.T) {
+	primary := &FailingLayer{Layer: layer.NewMemory[int, int](layer.MemoryConfig{})}
+	secondary := &FailingLayer{Layer: layer.NewMemory[int, int](layer.MemoryConfig{})}
+	replicated := layer.NewReplicated(layer.ReplicatedConfig[int, int]{
+		Replicas:         []lapis.Layer[int, int]{primary, secondary},
+		FailureThreshold: 2,
+		RetryInterval:    time.Hour,
+	})
+
+	// values are set to all replicas
+	assert.Nil(t, replicated.Set([]int{1, 2}, []int{10, 20}))
+	values, _ := secondary.Get([]int{1, 2})
+	assert.Equal(t, []int{10, 20}, values)
+
+	// keys missing in the primary are read from the secondary
+	assert.Nil(t, secondary.Set([]int{3}, []int{30}))
+	values, errs := replicated.Get([]int{1, 3, 4})
+	assert.Equal(t, []int{10, 30, 0}, values)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Equal(t, lapis.NewErrNotFound(4), errs[2])
+
+	// failing keys fall back to the secondary and the primary turns unhealthy after repeated failures
+	primary.SetDown(true)
+	for i := 0; i < 2; i++ {
+		values, errs = replicated.Get([]int{1, 2})
+		assert.Equal(t, []int{10, 20}, values)
+		assert.Equal(t, []error{nil, nil}, errs)
+	}
+	assert.False(t, replicated.Health()[0].Healthy)
+	assert.True(t, replicated.Health()[1].Healthy)
+
+	// unhealthy replicas are read last
+	calls := primary.Calls()
+	replicated.Get([]int{1})
+	assert.Equal(t, calls, primary.Calls())
+
+	// sets fail when a replica fails
+	errs = replicated.Set([]int{5}, []int{50})
+	assert.Equal(t, errReplicaDown, errs[0])
+
+	// the lowest latency replica is read first
+	slow := &FailingLayer{Layer: &SettableBackend{fakeDelay: 20 * time.Millisecond, multiplier: 1}}
+	fast := &FailingLayer{Layer: &SettableBackend{multiplier: 2}}
+	lowest := layer.NewReplicated(layer.ReplicatedConfig[int, int]{
+		Replicas: []lapis.Layer[int, int]{slow, fast},
+		Strategy: layer.ReadLowestLatency,
+	})
+	lowest.Get([]int{1})
+	lowest.Get([]int{1})
+	calls = slow.Calls()
+	for i := 0; i < 3; i++ {
+		values, _ = lowest.Get([]int{1})
+		assert.Equal(t, []int{2}, values)
+	}
+	assert.Equal(t, calls, slow.Calls())
+
+	// panicking replicas fail their keys like failing replicas instead of crashing
+	memory := layer.NewMemory[int, int](layer.MemoryConfig{})
+	panicking := layer.NewReplicated(layer.ReplicatedConfig[int, int]{
+		Replicas:         []lapis.Layer[int, int]{PanickingLayer{}, memory},
+		FailureThreshold: 2,
+	})
+	store, err := lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{panicking, &CountingBackend{multiplier: 1}},
+	})
+	assert.Nil(t, err)
+	errs = store.Set(13, 130)
+	assert.IsType(t, lapis.ErrLayerPanic{}, errs[0])
+	assert.Equal(t, "PanickingLayer", errs[0].(lapis.ErrLayerPanic).Layer)
+	values, _ = memory.Get([]int{13})
+	assert.Equal(t, []int{130}, values)
+	assert.Equal(t, 1, panicking.Health()[0].Failures)
+	values, errs = panicking.Get([]int{13})
+	assert.Equal(t, []int{130}, values)
+	assert.Equal(t, []error{nil}, errs)
+	assert.False(t, panicking.Health()[0].Healthy)
+}
+
+func TestGuardLayer(t *testing.T) {
+	backend := &CountingBackend{multiplier: 2}
+	guard := layer.NewGuard[int, int](layer.GuardConfig[int]{
+		Filter: layer.NewBloomFilter(layer.BloomConfig{Capacity: 1000}),
+		Source: func() lapis.KeySource[int] { return lapis.KeyList(generateKeys(100)) },
+	})
+	defer guard.Close()
+	assert.Eventually(t, func() bool {
+		_, errs := guard.Get([]int{1000})
+		err, ok := errs[0].(lapis.ErrNotFound[int])
+		return ok && err.Authoritative()
+	}, time.Second, time.Millisecond)
+
+	store, err := lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{layer.NewMemory[int, int](layer.MemoryConfig{}), guard, backend},
+	})
+	assert.Nil(t, err)
+
+	// keys that can't exist don't reach the backend
+	values, errs := store.LoadAll([]int{5, 1000, 1001})
+	assert.Equal(t, 10, values[0])
+	assert.Nil(t, errs[0])
+	for _, err := range errs[1:] {
+		assert.IsType(t, lapis.ErrNotFound[int]{}, err)
+		assert.True(t, err.(lapis.ErrNotFound[int]).Authoritative())
+	}
+	assert.Equal(t, 1, backend.Count())
+
+	// set keys are added to the filter
+	store.Set(1000, 7)
+	value, err := store.Load(1000, lapis.LoadSkipLayer("memory"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, value)
+	assert.Equal(t, 2, backend.Count())
+
+	// without a source the in-memory filter is never built, so every key reaches the backend
+	unbuilt := layer.NewGuard[int, int](layer.GuardConfig[int]{Filter: layer.NewBloomFilter(layer.BloomConfig{Capacity: 1000})})
+	unguarded, err := lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{unbuilt, &CountingBackend{multiplier: 2}},
+	})
+	assert.Nil(t, err)
+	value, err = unguarded.Load(5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, value)
+	assert.Nil(t, unbuilt.Close())
+	assert.Nil(t, unbuilt.Close())
+
+	// the redis filter is shared across instances and rebuilt into a separate key
+	pool := newFakeRedisBitmapPool(t)
+	config := layer.RedisBloomConfig{BloomConfig: layer.BloomConfig{Capacity: 1000}, Connection: pool, Key: "bloom"}
+	shared := layer.NewGuard[int, int](layer.GuardConfig[int]{Filter: layer.NewRedisBloomFilter(config)})
+
+	// keys are let through until the shared filter is built, even once keys are added to it
+	assert.Nil(t, shared.Set([]int{4}, []int{4}))
+	_, errs = shared.Get([]int{1, 5})
+	for _, err := range errs {
+		assert.False(t, err.(lapis.ErrNotFound[int]).Authoritative())
+	}
+
+	builder := layer.NewGuard[int, int](layer.GuardConfig[int]{
+		Filter: layer.NewRedisBloomFilter(config),
+		Source: func() lapis.KeySource[int] { return lapis.KeyList([]int{1, 2, 3}) },
+	})
+	defer builder.Close()
+	assert.Eventually(t, func() bool {
+		_, errs := shared.Get([]int{5})
+		return errs[0].(lapis.ErrNotFound[int]).Authoritative()
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, shared.Set([]int{4}, []int{4}))
+	_, errs = shared.Get([]int{1, 3, 4, 5})
+	for i, exists := range []bool{true, true, true, false} {
+		assert.Equal(t, !exists, errs[i].(lapis.ErrNotFound[int]).Authoritative())
+	}
+}
+
+func TestRedisBloomFilterRebuild(t *testing.T) {
+	pool := newFakeRedisBitmapPool(t)
+	config := layer.RedisBloomConfig{BloomConfig: layer.BloomConfig{Capacity: 1000}, Connection: pool, Key: "bloom"}
+	builder, other := layer.NewRedisBloomFilter(config), layer.NewRedisBloomFilter(config)
+
+	// a filter that was never built is not trusted
+	_, err := other.Test([]string{"1"})
+	assert.Equal(t, layer.ErrFilterNotBuilt, err)
+
+	// keys added by other instances during a rebuild are kept, and concurrent rebuilds don't drop each other
+	assert.Nil(t, builder.Rebuild(func(add func(keys []string) error) error {
+		assert.Nil(t, add([]string{"1"}))
+		assert.Nil(t, other.Add([]string{"2"}))
+		assert.Nil(t, other.Rebuild(func(add func(keys []string) error) error {
+			assert.Nil(t, other.Add([]string{"3"}))
+			return add([]string{"4"})
+		}))
+		assert.Nil(t, other.Add([]string{"5"}))
+		return nil
+	}))
+	present, err := other.Test([]string{"1", "2", "3", "4", "5", "6"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true, true, false, true, false}, present)
+
+	// a failed rebuild keeps the filter
+	errFill := fmt.Errorf("source failed")
+	assert.Equal(t, errFill, builder.Rebuild(func(add func(keys []string) error) error {
+		assert.Nil(t, add([]string{"6"}))
+		return errFill
+	}))
+	present, err = other.Test([]string{"1", "6"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false}, present)
+
+	// an empty rebuild is trusted and holds no key
+	assert.Nil(t, builder.Rebuild(func(add func(keys []string) error) error { return nil }))
+	present, err = other.Test([]string{"1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false}, present)
+}
+
+func TestMappedLayers(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	inner := layer.NewMemory[string, []byte](layer.MemoryConfig{})
+	errNegative := fmt.Errorf("negative key")
+	mapped := layer.MapKeys[int, string, user](layer.MapValues[string, user, []byte](inner, layer.CodecConverter[user](lapis.JSONCodec{})), func(key int) (string, error) {
+		if key < 0 {
+			return "", errNegative
+		}
+		return "user:" + strconv.Itoa(key), nil
+	})
+
+	store, err := lapis.New(lapis.Config[int, user]{
+		Layers: []lapis.Layer[int, user]{mapped, FuncBackend[int, user]{load: func(key int) user {
+			return user{ID: key, Name: "user " + strconv.Itoa(key)}
+		}}},
+	})
+	assert.Nil(t, err)
+
+	// values are stored in the wrapped layer with its own types
+	value, err := store.Load(1)
+	assert.Nil(t, err)
+	assert.Equal(t, user{ID: 1, Name: "user 1"}, value)
+	assert.Eventually(t, func() bool {
+		values, errs := inner.Get([]string{"user:1"})
+		return errs[0] == nil && string(values[0]) == `{"ID":1,"Name":"user 1"}`
+	}, time.Second, time.Millisecond)
+
+	// not found errors are converted to the keys of the store and conversion errors are reported per key
+	values, errs := mapped.Get([]int{1, 2, -1})
+	assert.Equal(t, user{ID: 1, Name: "user 1"}, values[0])
+	assert.Nil(t, errs[0])
+	assert.Equal(t, lapis.NewErrNotFound(2), errs[1])
+	assert.Equal(t, errNegative, errs[2])
+	assert.Equal(t, []error{errNegative}, mapped.Set([]int{-1}, []user{{}}))
+
+	// values failing to be decoded have the codec error
+	inner.Set([]string{"user:3"}, [][]byte{[]byte("{")})
+	_, errs = mapped.Get([]int{3})
+	assert.NotNil(t, errs[0])
+}
+
+func TestDerive(t *testing.T) {
+	users, _ := lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{layer.NewMemory[int, int](layer.MemoryConfig{}), &CountingBackend{multiplier: 1}},
+	})
+	settings, _ := lapis.New(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{layer.NewMemory[int, int](layer.MemoryConfig{}), &CountingBackend{multiplier: 10}},
+	})
+	sameKey := func(key int) []int { return []int{key} }
+
+	// profiles are the sum of the user and the settings
+	var mu sync.Mutex
+	var batches [][]int
+	profiles, err := lapis.Derive(lapis.Config[int, int]{
+		Batcher: &lapis.BatcherConfig[int, int]{MaxBatch: 100, Wait: 10 * time.Millisecond},
+		Layers:  []lapis.Layer[int, int]{layer.NewMemory[int, int](layer.MemoryConfig{})},
+	}, func(keys []int) ([]int, []error) {
+		mu.Lock()
+		batches = append(batches, keys)
+		mu.Unlock()
+		userValues, errs := users.LoadAll(keys)
+		settingValues, _ := settings.LoadAll(keys)
+		for i := range keys {
+			userValues[i] += settingValues[i]
+		}
+		return userValues, errs
+	}, lapis.DependsOn(users, sameKey), lapis.DependsOn(settings, sameKey))
+	assert.Nil(t, err)
+
+	// keys of a batch are computed together and cached
+	values, _ := profiles.LoadAll([]int{1, 2, 3})
+	assert.Equal(t, []int{11, 22, 33}, values)
+	profiles.LoadAll([]int{1, 2, 3})
+	assert.Len(t, batches, 1)
+	assert.ElementsMatch(t, []int{1, 2, 3}, batches[0])
+
+	// changing a dependency evicts the derived values computed from it
+	users.Set(2, 200)
+	settings.Set(3, 300)
+	values, _ = profiles.LoadAll([]int{1, 2, 3})
+	assert.Equal(t, []int{11, 220, 303}, values)
+	assert.Len(t, batches, 2)
+	assert.ElementsMatch(t, []int{2, 3}, batches[1])
+
+	// stores derived from derived stores are invalidated in turn
+	doubled, err := lapis.Derive(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{layer.NewMemory[int, int](layer.MemoryConfig{})},
+	}, func(keys []int) ([]int, []error) {
+		values, errs := profiles.LoadAll(keys)
+		for i := range values {
+			values[i] *= 2
+		}
+		return values, errs
+	}, lapis.DependsOn(profiles, sameKey))
+	assert.Nil(t, err)
+	value, _ := doubled.Load(1)
+	assert.Equal(t, 22, value)
+	users.Set(1, 100)
+	value, _ = doubled.Load(1)
+	assert.Equal(t, 220, value)
+
+	// a value computed while its dependency changes is not kept
+	cache := layer.NewMemory[int, int](layer.MemoryConfig{})
+	computing, release := make(chan struct{}), make(chan struct{})
+	slow, err := lapis.Derive(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{cache},
+	}, func(keys []int) ([]int, []error) {
+		values, errs := users.LoadAll(keys)
+		computing <- struct{}{}
+		<-release
+		return values, errs
+	}, lapis.DependsOn(users, sameKey))
+	assert.Nil(t, err)
+	go func() {
+		<-computing
+		users.Set(5, 500)
+		close(release)
+	}()
+	value, _ = slow.Load(5)
+	assert.Equal(t, 5, value)
+	time.Sleep(50 * time.Millisecond)
+	_, errs := cache.Get([]int{5})
+	assert.Equal(t, lapis.NewErrNotFound(5), errs[0])
+	go func() { <-computing }()
+	value, _ = slow.Load(5)
+	assert.Equal(t, 500, value)
+
+	// layers that can't evict derived values are rejected
+	_, err = lapis.Derive(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{&CountingBackend{multiplier: 1}},
+	}, func(keys []int) ([]int, []error) { return keys, nil })
+	assert.Equal(t, lapis.ErrUntaggedLayer{Layer: "CountingBackend"}, err)
+
+	// values are tagged through SetEntries, so evicting by tag alone is not enough
+	_, err = lapis.Derive(lapis.Config[int, int]{
+		Layers: []lapis.Layer[int, int]{&TagOnlyBackend{CountingBackend: CountingBackend{multiplier: 1}}},
+	}, func(keys []int) ([]int, []error) { return keys, nil })
+	assert.Equal(t, lapis.ErrUntaggedLayer{Layer: "CountingBackend"}, err)
+}
+
+func TestListStore(t *testing.T) {
+	// posts are stored in memory, post N is written by author N / 10
+	postLayer := layer.NewMemory[int, string](layer.MemoryConfig{})
+	posts, _ := lapis.New(lapis.Config[int, string]{Layers: []lapis.Layer[int, string]{postLayer}})
+	for id := 10; id < 40; id++ {
+		posts.Set(id, "post "+strconv.Itoa(id))
+	}
+
+	var mu sync.Mutex
+	var queries [][]lapis.ListKey[int]
+	postsByAuthor, err := lapis.NewList(lapis.ListConfig[int, int, string]{
+		Config: lapis.Config[lapis.ListKey[int], []int]{
+			Layers: []lapis.Layer[lapis.ListKey[int], []int]{layer.NewMemory[lapis.ListKey[int], []int](layer.MemoryConfig{})},
+		},
+		Load: func(keys []lapis.ListKey[int]) ([][]int, []error) {
+			mu.Lock()
+			queries = append(queries, keys)
+			mu.Unlock()
+			result := make([][]int, len(keys))
+			for i, key := range keys {
+				ids := []int{}
+				for id := key.Parent * 10; id < key.Parent*10+10; id++ {
+					ids = append(ids, id)
+				}
+				result[i] = lapis.Paginate(ids, key.Page)
+			}
+			return result, nil
+		},
+		Entities: posts,
+	})
+	assert.Nil(t, err)
+
+	// the lists of many parents are loaded with one query
+	page := lapis.Page{Offset: 2, Limit: 2}
+	values, errs := postsByAuthor.LoadAll([]lapis.ListKey[int]{{Parent: 1, Page: page}, {Parent: 2, Page: page}})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, [][]string{{"post 12", "post 13"}, {"post 22", "post 23"}}, values)
+	assert.Len(t, queries, 1)
+
+	// the ID lists are cached and the children are shared with point loads
+	postLayer.Set([]int{13}, []string{"post 13 edited"})
+	assert.Eventually(t, func() bool {
+		values, _ := postsByAuthor.Load(1, page)
+		return assert.ObjectsAreEqual([]string{"post 12", "post 13 edited"}, values)
+	}, time.Second, time.Millisecond)
+	assert.Len(t, queries, 1)
+
+	// children that are not found are left out
+	list, err := postsByAuthor.Load(4, lapis.Page{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, list)
+	assert.Len(t, queries, 2)
+
+	// invalidating a parent evicts all of its pages
+	postsByAuthor.InvalidateParents(1)
+	postsByAuthor.Load(1, page)
+	postsByAuthor.Load(2, page)
+	assert.Len(t, queries, 3)
+}
+
+func TestQueryStore(t *testing.T) {
+	type search struct {
+		Tags    []string
+		Filters map[string]int
+	}
+	var mu sync.Mutex
+	var batches [][]search
+	searches, err := lapis.NewQuery(lapis.QueryConfig[search, string, int]{
+		Config: lapis.Config[string, int]{
+			Batcher: &lapis.BatcherConfig[string, int]{MaxBatch: 100, Wait: 10 * time.Millisecond},
+			Layers:  []lapis.Layer[string, int]{layer.NewMemory[string, int](layer.MemoryConfig{})},
+		},
+		Key: lapis.JSONQueryKey[search],
+		Load: func(queries []search) ([]int, []error) {
+			mu.Lock()
+			batches = append(batches, queries)
+			mu.Unlock()
+			result := make([]int, len(queries))
+			for i, query := range queries {
+				result[i] = len(query.Tags) + query.Filters["min"]
+			}
+			return result, nil
+		},
+	})
+	assert.Nil(t, err)
+
+	// equal queries are loaded once and the final layer gets the original queries
+	query := search{Tags: []string{"a", "b"}, Filters: map[string]int{"min": 10, "max": 20}}
+	equal := search{Tags: []string{"a", "b"}, Filters: map[string]int{"max": 20, "min": 10}}
+	other := search{Tags: []string{"c"}}
+	values, errs := searches.LoadAll([]search{query, equal, other})
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, []int{12, 12, 1}, values)
+	assert.Len(t, batches, 1)
+	assert.ElementsMatch(t, []search{query, other}, batches[0])
+
+	// values are cached by their canonical keys
+	assert.Eventually(t, func() bool {
+		value, err := searches.Load(equal, lapis.LoadCacheOnly)
+		return err == nil && value == 12
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, searches.Set(other, 5)[0])
+	value, _ := searches.Load(search{Tags: []string{"c"}})
+	assert.Equal(t, 5, value)
+	assert.Len(t, batches, 1)
+
+	// the final layer fails keys without a query being loaded
+	_, err = searches.Store().Load(`{"Tags":["d"],"Filters":null}`)
+	assert.Equal(t, lapis.ErrUnknownQuery, err)
+}
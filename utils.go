@@ -40,16 +40,21 @@ func singlify[TKey comparable, TValue any](f BatchHandler[TKey, TValue]) Handler
 	}
 }
 
+// Remove duplicate keys while keeping the order of the first occurrences
+func dedupe[TKey comparable](keys []TKey) []TKey {
+	seen := make(map[TKey]struct{}, len(keys))
+	result := make([]TKey, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
 // Return the zero value of the given generic type
 func zero[T any]() T {
 	var zero T
 	return zero
 }
-
-func zeroFallback[T comparable](input T, fallback T) T {
-	var zero T
-	if input == zero {
-		return fallback
-	}
-	return input
-}
@@ -0,0 +1,168 @@
+package lapis
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// KeySource provides the keys to be loaded when warming a store
+type KeySource[TKey comparable] interface {
+	// Get the next set of keys, an empty set of keys means the source is exhausted
+	NextKeys(ctx context.Context) ([]TKey, error)
+}
+
+// Configuration for warming a store
+type WarmConfig struct {
+	// Number of keys loaded at once, defaults to 256
+	BatchSize int
+
+	// Maximum number of keys loaded per second, 0 = no limit
+	Rate float64
+
+	// Called after each batch of keys is loaded
+	Progress func(progress WarmProgress)
+
+	// Load options used to load the keys
+	LoadOptions []LoadOption
+}
+
+// Progress of warming a store
+type WarmProgress struct {
+	// Number of keys that have been loaded successfully
+	Loaded int
+
+	// Number of keys that failed to be loaded, including keys that are not found
+	Failed int
+
+	// How long the store has been warming
+	Elapsed time.Duration
+}
+
+// Load every key from the given source so the layers are primed with their values, such as after a deploy
+// Keys are loaded in batches and paced to the configured rate, returns the final progress along with the
+// error of the key source or the context
+func (r *Store[TKey, TValue]) Warm(ctx context.Context, source KeySource[TKey], config WarmConfig) (WarmProgress, error) {
+	batchSize := fallback.Zero(config.BatchSize, 256)
+	start := time.Now()
+	progress := WarmProgress{}
+	var pending []TKey
+	for {
+		keys, err := source.NextKeys(ctx)
+		if err != nil {
+			return progress, err
+		}
+		pending = append(pending, keys...)
+		exhausted := len(keys) == 0
+		for len(pending) >= batchSize || (exhausted && len(pending) > 0) {
+			count := batchSize
+			if count > len(pending) {
+				count = len(pending)
+			}
+			batch := pending[:count]
+			pending = pending[count:]
+
+			_, loadErrors := r.LoadAllFuture(batch, config.LoadOptions...).GetCtx(ctx)
+			if err := ctx.Err(); err != nil {
+				return progress, err
+			}
+			for _, err := range loadErrors {
+				if err != nil {
+					progress.Failed++
+				} else {
+					progress.Loaded++
+				}
+			}
+			progress.Elapsed = time.Since(start)
+			if config.Progress != nil {
+				config.Progress(progress)
+			}
+
+			// wait until the loaded keys are within the rate
+			if config.Rate > 0 {
+				next := start.Add(time.Duration(float64(progress.Loaded+progress.Failed) / config.Rate * float64(time.Second)))
+				if err := sleepCtx(ctx, time.Until(next)); err != nil {
+					return progress, err
+				}
+			}
+		}
+		if exhausted {
+			return progress, nil
+		}
+	}
+}
+
+// sleep for the given duration or until the context is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// KeyList is a key source of a fixed set of keys
+func KeyList[TKey comparable](keys []TKey) KeySource[TKey] {
+	return &keyList[TKey]{keys: keys}
+}
+
+type keyList[TKey comparable] struct {
+	keys []TKey
+}
+
+func (s *keyList[TKey]) NextKeys(ctx context.Context) ([]TKey, error) {
+	keys := s.keys
+	s.keys = nil
+	return keys, nil
+}
+
+// number of keys in each chunk of a key snapshot
+const keySnapshotChunk = 1024
+
+// Write a snapshot of keys, such as the keys held by the memory layer of a running instance, to be read by
+// KeySnapshot on another instance
+func WriteKeySnapshot[TKey comparable](w io.Writer, keys []TKey) error {
+	encoder := gob.NewEncoder(w)
+	for len(keys) > 0 {
+		count := keySnapshotChunk
+		if count > len(keys) {
+			count = len(keys)
+		}
+		if err := encoder.Encode(keys[:count]); err != nil {
+			return err
+		}
+		keys = keys[count:]
+	}
+	return nil
+}
+
+// KeySnapshot is a key source reading a snapshot written by WriteKeySnapshot, such as the body of a response from
+// another instance, the keys are read as they are needed
+func KeySnapshot[TKey comparable](r io.Reader) KeySource[TKey] {
+	return &keySnapshot[TKey]{decoder: gob.NewDecoder(r)}
+}
+
+type keySnapshot[TKey comparable] struct {
+	decoder *gob.Decoder
+}
+
+func (s *keySnapshot[TKey]) NextKeys(ctx context.Context) ([]TKey, error) {
+	var keys []TKey
+	if err := s.decoder.Decode(&keys); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,93 @@
+package lapis
+
+import "context"
+
+// Write a value to the final layer and prime the caches according to the configured write mode
+// The future is resolved with the written value once the final layer has accepted or rejected the write
+func (r *Store[TKey, TValue]) Write(key TKey, value TValue, flags ...SetFlag) *Future[TValue] {
+	return r.WriteAll([]TKey{key}, []TValue{value}, flags...)[0]
+}
+
+// Write a set of values to the final layer and prime the caches according to the configured write mode
+// Each future is resolved with the written value once the final layer has accepted or rejected the write,
+// the set flags only apply to priming the caches since the final layer is always written separately
+// In the write-behind mode a write of a key that is still queued replaces the queued value, so the futures of both
+// writes are resolved with the outcome of writing the newer value
+func (r *Store[TKey, TValue]) WriteAll(keys []TKey, values []TValue, flags ...SetFlag) Futures[TValue] {
+	if r.writeMode == WriteNone {
+		futures := make(Futures[TValue], len(keys))
+		for i := range futures {
+			futures[i] = failedFuture[TValue](ErrNotWritable)
+		}
+		return futures
+	}
+	futures, _ := r.write(keys, values, flags)
+	return futures
+}
+
+// Block until all of the queued writes are written to the final layer or the context is cancelled
+// Returns immediately if the store is not in the write-behind mode
+func (r *Store[TKey, TValue]) Flush(ctx context.Context) error {
+	if r.writeQueue == nil {
+		return nil
+	}
+	return r.writeQueue.drain(ctx)
+}
+
+// write a set of values to the final layer and prime the caches with the accepted values
+// in the write-through mode values are only accepted after they are written, while in the write-behind mode
+// values are accepted once they are queued
+func (r *Store[TKey, TValue]) write(keys []TKey, values []TValue, flags []SetFlag) (Futures[TValue], [][]error) {
+	var traceID uint64 = r.getTraceID()
+	var errors = make([][]error, len(r.layers))
+	var finalLayer = len(r.layers) - 1
+	results, futures := newResolveResults[TValue](len(keys))
+
+	r.preSet(traceID, keys, values)
+
+	if r.writeMode == WriteThrough {
+		errors[finalLayer] = r.layerSet(traceID, finalLayer, keys, values, nil)
+		for i := range keys {
+			var err error
+			if len(errors[finalLayer]) > 0 {
+				err = errors[finalLayer][i]
+			}
+			results.finishKey(i, values[i], err)
+		}
+	} else {
+		errors[finalLayer] = r.writeQueue.enqueue(keys, values, results.finishKey)
+	}
+
+	// prime the caches with the accepted values only
+	cacheIndexes, sequential := setOrder(finalLayer, flags)
+	acceptedIndexes := make([]int, 0, len(keys))
+	for i := range keys {
+		if len(errors[finalLayer]) == 0 || errors[finalLayer][i] == nil {
+			acceptedIndexes = append(acceptedIndexes, i)
+		}
+	}
+	primeErrors := make([][]error, len(cacheIndexes))
+	if len(acceptedIndexes) == len(keys) {
+		r.setLayers(traceID, cacheIndexes, keys, values, sequential, primeErrors)
+		for i, layerIndex := range cacheIndexes {
+			errors[layerIndex] = primeErrors[i]
+		}
+	} else if len(acceptedIndexes) > 0 {
+		r.setLayers(traceID, cacheIndexes, extract(keys, acceptedIndexes), extract(values, acceptedIndexes), sequential, primeErrors)
+		for i, layerIndex := range cacheIndexes {
+			if len(primeErrors[i]) > 0 {
+				errors[layerIndex] = make([]error, len(keys))
+				mergeWithIndexes(errors[layerIndex], primeErrors[i], acceptedIndexes)
+			}
+		}
+	}
+
+	r.postSet(traceID, keys, values, errors)
+
+	return futures, errors
+}
+
+// write a batch of queued writes to the final layer
+func (r *Store[TKey, TValue]) writeBatch(keys []TKey, values []TValue) []error {
+	return r.layerSet(r.getTraceID(), len(r.layers)-1, keys, values, nil)
+}
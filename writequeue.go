@@ -0,0 +1,217 @@
+package lapis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/flowscan/lapis/internal/fallback"
+)
+
+// a queue of writes waiting to be written to the final layer in batches
+type writeQueue[TKey comparable, TValue any] struct {
+	// writes a batch to the final layer
+	write func(keys []TKey, values []TValue) []error
+
+	maxBatch  int
+	wait      time.Duration
+	retries   int
+	retryWait time.Duration
+	maxQueued int
+
+	// writes waiting to be written, oldest first, writes of a key that is already queued replace the queued value
+	pending []*queuedWrite[TKey, TValue]
+	queued  map[TKey]*queuedWrite[TKey, TValue]
+
+	// number of writes queued or being written, and the channel closed when it drops to 0
+	outstanding int
+	drained     chan struct{}
+
+	// channel to wake the writer up when writes are queued, closed to stop the writer once the queue is written
+	wake   chan struct{}
+	closed bool
+
+	// channel closed when the writer has stopped
+	stopped chan struct{}
+
+	mu sync.Mutex
+}
+
+// a value waiting to be written and the callers to notify once it is written
+type queuedWrite[TKey comparable, TValue any] struct {
+	key    TKey
+	value  TValue
+	finish []func(err error)
+}
+
+// create a new write queue and start its writer
+func newWriteQueue[TKey comparable, TValue any](config WriteConfig, write func(keys []TKey, values []TValue) []error) *writeQueue[TKey, TValue] {
+	q := &writeQueue[TKey, TValue]{
+		write:     write,
+		maxBatch:  fallback.Zero(config.MaxBatch, 256),
+		wait:      fallback.Zero(config.Wait, 10*time.Millisecond),
+		retries:   fallback.Zero(config.Retries, 3),
+		retryWait: fallback.Zero(config.RetryWait, 100*time.Millisecond),
+		maxQueued: config.MaxQueued,
+		queued:    make(map[TKey]*queuedWrite[TKey, TValue]),
+		wake:      make(chan struct{}, 1),
+		stopped:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// queue a set of writes, finishKey is called for each key once it is written
+// A write of a key that is already queued replaces the queued value, and the replaced write is finished with the
+// outcome of writing the new value
+// Returns ErrOverloaded for the keys that can't be queued because the queue is full, or ErrClosed for every key if
+// the queue is closed, nil if all keys are queued
+func (q *writeQueue[TKey, TValue]) enqueue(keys []TKey, values []TValue, finishKey func(index int, value TValue, err error)) []error {
+	var errors []error
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		errors = make([]error, len(keys))
+		for i := range keys {
+			errors[i] = ErrClosed
+			finishKey(i, values[i], ErrClosed)
+		}
+		return errors
+	}
+	for i, key := range keys {
+		index := i
+		finish := func(err error) { finishKey(index, values[index], err) }
+		if w, ok := q.queued[key]; ok {
+			w.value = values[i]
+			w.finish = append(w.finish, finish)
+			continue
+		}
+		if q.maxQueued > 0 && q.outstanding >= q.maxQueued {
+			if errors == nil {
+				errors = make([]error, len(keys))
+			}
+			errors[i] = ErrOverloaded
+			finish(ErrOverloaded)
+			continue
+		}
+		w := &queuedWrite[TKey, TValue]{key: key, value: values[i], finish: []func(err error){finish}}
+		q.pending = append(q.pending, w)
+		q.queued[key] = w
+		if q.outstanding == 0 {
+			q.drained = make(chan struct{})
+		}
+		q.outstanding++
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return errors
+}
+
+// write the queued writes in batches whenever writes are queued, until the queue is closed
+func (q *writeQueue[TKey, TValue]) run() {
+	defer close(q.stopped)
+	for range q.wake {
+		// collect writes for a while before writing them
+		time.Sleep(q.wait)
+		q.writePending()
+	}
+	q.writePending()
+}
+
+// write every pending write in batches
+func (q *writeQueue[TKey, TValue]) writePending() {
+	for {
+		q.mu.Lock()
+		count := len(q.pending)
+		if count > q.maxBatch {
+			count = q.maxBatch
+		}
+		batch := q.pending[:count]
+		q.pending = append([]*queuedWrite[TKey, TValue](nil), q.pending[count:]...)
+		for _, w := range batch {
+			delete(q.queued, w.key)
+		}
+		q.mu.Unlock()
+		if count == 0 {
+			return
+		}
+		q.flush(batch)
+	}
+}
+
+// stop accepting writes and block until the queued writes are written and the writer has stopped
+func (q *writeQueue[TKey, TValue]) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+	q.mu.Unlock()
+	<-q.stopped
+}
+
+// write a batch to the final layer, failed writes are retried with an exponential backoff
+func (q *writeQueue[TKey, TValue]) flush(batch []*queuedWrite[TKey, TValue]) {
+	retryWait := q.retryWait
+	for attempt := 0; ; attempt++ {
+		keys := make([]TKey, len(batch))
+		values := make([]TValue, len(batch))
+		for i, w := range batch {
+			keys[i] = w.key
+			values[i] = w.value
+		}
+		errors := q.write(keys, values)
+
+		var failed []*queuedWrite[TKey, TValue]
+		for i, w := range batch {
+			var err error
+			if len(errors) > 0 {
+				err = errors[i]
+			}
+			if err != nil && attempt < q.retries {
+				failed = append(failed, w)
+				continue
+			}
+			q.finish(w, err)
+		}
+		if len(failed) == 0 {
+			return
+		}
+		batch = failed
+		time.Sleep(retryWait)
+		retryWait *= 2
+	}
+}
+
+// notify the callers of a write that it is finished
+func (q *writeQueue[TKey, TValue]) finish(w *queuedWrite[TKey, TValue], err error) {
+	for _, finish := range w.finish {
+		finish(err)
+	}
+	q.mu.Lock()
+	q.outstanding--
+	if q.outstanding == 0 {
+		close(q.drained)
+	}
+	q.mu.Unlock()
+}
+
+// block until there are no outstanding writes or the context is cancelled
+func (q *writeQueue[TKey, TValue]) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if q.outstanding == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	drained := q.drained
+	q.mu.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}